@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const archiveIndexFile = "index.json"
+
+// autoRestoreInterval is how long to wait before loading an archived image again after it failed
+const autoRestoreInterval = time.Hour
+
+// restoreAttempts keeps the last time the automatic restore tried to load a tag
+var restoreAttempts = make(map[string]time.Time)
+
+type ArchiveEntry struct {
+	File     string    `json:"file"`
+	ID       string    `json:"id"`
+	Tags     []string  `json:"tags"`
+	Size     int64     `json:"size"`
+	Archived time.Time `json:"archived"`
+	Used     time.Time `json:"used"`
+	Restored time.Time `json:"restored,omitempty"`
+}
+
+type ImageArchive struct {
+	lock    sync.Mutex
+	dir     string
+	maxSize int64
+	minSize int64
+	entries []ArchiveEntry
+}
+
+var imageArchive *ImageArchive
+
+func openImageArchive(dir string, maxSize, minSize int64) (*ImageArchive, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ImageArchive{
+		dir:     dir,
+		maxSize: maxSize,
+		minSize: minSize,
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, archiveIndexFile))
+	if err == nil {
+		err = json.Unmarshal(data, &a.entries)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// sameFilesystem is used to warn when the archive takes the space it should free
+func sameFilesystem(path, otherPath string) bool {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	otherStat, err := os.Stat(otherPath)
+	if err != nil {
+		return false
+	}
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	otherSys, otherOk := otherStat.Sys().(*syscall.Stat_t)
+	return ok && otherOk && sys.Dev == otherSys.Dev
+}
+
+func (a *ImageArchive) save() error {
+	data, err := json.MarshalIndent(a.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(a.dir, archiveIndexFile), data)
+}
+
+func (a *ImageArchive) size() (size int64) {
+	for _, entry := range a.entries {
+		size += entry.Size
+	}
+	return
+}
+
+func (a *ImageArchive) find(name string) int {
+	for idx, entry := range a.entries {
+		if entry.ID == name {
+			return idx
+		}
+		for _, tag := range entry.Tags {
+			if tag == name || tag == normalizeImageName(name) {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+func (a *ImageArchive) remove(idx int) {
+	entry := a.entries[idx]
+	os.Remove(filepath.Join(a.dir, entry.File))
+	a.entries = append(a.entries[:idx], a.entries[idx+1:]...)
+}
+
+// evict removes the least recently used archives until the archive fits its size budget
+func (a *ImageArchive) evict() {
+	sort.SliceStable(a.entries, func(i, j int) bool {
+		return a.entries[i].Used.After(a.entries[j].Used)
+	})
+	for len(a.entries) > 0 && a.size() > a.maxSize {
+		entry := a.entries[len(a.entries)-1]
+		logrus.WithFields(logrus.Fields{
+			"image": entry.ID,
+			"tags":  entry.Tags,
+			"bytes": entry.Size,
+		}).Infoln("Removed archived image")
+		a.remove(len(a.entries) - 1)
+	}
+}
+
+func (a *ImageArchive) shouldArchive(image docker.APIImages) bool {
+	if a == nil {
+		return false
+	}
+	if image.Size < a.minSize || image.Size > a.maxSize {
+		return false
+	}
+	// untagged images can't be found to be restored
+	for _, tag := range image.RepoTags {
+		if tag != untaggedImage {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ImageArchive) Archive(client DockerClient, image docker.APIImages) error {
+	if !a.shouldArchive(image) {
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range image.RepoTags {
+		if tag != untaggedImage {
+			tags = append(tags, tag)
+		}
+	}
+
+	file, err := ioutil.TempFile(a.dir, "image")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	err = client.ExportImages(dockerContext, docker.ExportImagesOptions{
+		Names:        tags,
+		OutputStream: file,
+	})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(file.Name())
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entry := ArchiveEntry{
+		File:     strings.TrimPrefix(image.ID, "sha256:") + ".tar",
+		ID:       image.ID,
+		Tags:     tags,
+		Size:     stat.Size(),
+		Archived: time.Now(),
+		Used:     time.Now(),
+	}
+	if idx := a.find(image.ID); idx >= 0 {
+		a.remove(idx)
+	}
+	err = os.Rename(file.Name(), filepath.Join(a.dir, entry.File))
+	if err != nil {
+		return err
+	}
+	a.entries = append(a.entries, entry)
+	a.evict()
+
+	logrus.WithFields(imageFields(image)).Infoln("Archived image to", filepath.Join(a.dir, entry.File),
+		"archive uses", humanize.Bytes(uint64(a.size())))
+	return a.save()
+}
+
+func (a *ImageArchive) Restore(client DockerClient, name string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	idx := a.find(name)
+	if idx < 0 {
+		return fmt.Errorf("image %s is not archived", name)
+	}
+
+	file, err := os.Open(filepath.Join(a.dir, a.entries[idx].File))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = client.LoadImage(dockerContext, docker.LoadImageOptions{
+		InputStream: file,
+	})
+	if err != nil {
+		return err
+	}
+
+	a.entries[idx].Used = time.Now()
+	a.entries[idx].Restored = a.entries[idx].Used
+	logrus.WithFields(logrus.Fields{
+		"image": a.entries[idx].ID,
+		"tags":  a.entries[idx].Tags,
+	}).Infoln("Restored archived image")
+	return a.save()
+}
+
+// restoredAfter checks if the tag was loaded from the archive after the time. The index is read
+// from the disk, so the images loaded by the restore command are found as well.
+func (a *ImageArchive) restoredAfter(tag string, t time.Time) bool {
+	if a == nil {
+		return false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	data, err := ioutil.ReadFile(filepath.Join(a.dir, archiveIndexFile))
+	if err != nil {
+		return false
+	}
+	var entries []ArchiveEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		for _, entryTag := range entry.Tags {
+			if entryTag == tag && entry.Restored.After(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// missingReferencedTags returns the archived tags the running containers were created from
+// that are not on the host anymore with the size of their archives
+func (a *ImageArchive) missingReferencedTags(now time.Time) (tags []string, sizes map[string]int64) {
+	local := make(map[string]bool)
+	for id, image := range imagesUsed {
+		local[id] = true
+		for _, tag := range image.RepoTags {
+			local[tag] = true
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	sizes = make(map[string]int64)
+	for _, container := range inspectedContainers {
+		// the stopped containers refer to the images the cleanup removed on purpose
+		if !container.State.Running || container.Config == nil || container.Config.Image == "" {
+			continue
+		}
+		tag := normalizeImageName(container.Config.Image)
+		if local[tag] || now.Sub(restoreAttempts[tag]) < autoRestoreInterval {
+			continue
+		}
+		idx := a.find(tag)
+		if idx < 0 {
+			continue
+		}
+		local[tag] = true
+		tags = append(tags, tag)
+		sizes[tag] = a.entries[idx].Size
+	}
+	sort.Strings(tags)
+	return
+}
+
+// RestoreReferenced loads the archived images back when the running containers still refer
+// to their tags, as long as the free space stays above the expected free space
+func (a *ImageArchive) RestoreReferenced(client DockerClient, diskSpace DiskSpace, freeSpace uint64) {
+	if a == nil || !opts.ArchiveAutoRestore {
+		return
+	}
+
+	now := time.Now()
+	bytesFree := diskSpace.BytesFree
+	tags, sizes := a.missingReferencedTags(now)
+	for _, tag := range tags {
+		if isShuttingDown() {
+			return
+		}
+		size := uint64(sizes[tag])
+		if bytesFree < freeSpace+size {
+			logrus.Debugln("Not restoring", tag, "it would take the free space below", humanize.Bytes(freeSpace))
+			continue
+		}
+		restoreAttempts[tag] = now
+		if err := a.Restore(client, tag); err != nil {
+			logrus.Warningln("Failed to restore", tag, "referenced by a running container:", err)
+			continue
+		}
+		bytesFree -= size
+	}
+}
+
+func (a *ImageArchive) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tTAGS\tSIZE\tARCHIVED\tUSED")
+	for _, entry := range a.entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", shortID(entry.ID), strings.Join(entry.Tags, ","),
+			humanize.Bytes(uint64(entry.Size)), humanize.Time(entry.Archived), humanize.Time(entry.Used))
+	}
+	w.Flush()
+}
+
+func openImageArchiveFromOptions() (*ImageArchive, error) {
+	maxSize, err := humanize.ParseBytes(opts.ArchiveMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	minSize, err := humanize.ParseBytes(opts.ArchiveMinSize)
+	if err != nil {
+		return nil, err
+	}
+	return openImageArchive(opts.ArchiveDir, int64(maxSize), int64(minSize))
+}
+
+// pullImage is used by restore --pull to only restore the images
+// that can't be pulled from the registry
+func pullImage(client *CustomDockerClient, name string) error {
+	repository, tag := docker.ParseRepositoryTag(name)
+	if tag == "" {
+		tag = "latest"
+	}
+	return client.PullImage(dockerContext, docker.PullImageOptions{
+		Repository: repository,
+		Tag:        tag,
+	}, docker.AuthConfiguration{})
+}
+
+func runRestore(c *cli.Context) error {
+	if opts.ArchiveDir == "" {
+		return errors.New("the archive directory is not configured")
+	}
+
+	archive, err := openImageArchiveFromOptions()
+	if err != nil {
+		return err
+	}
+	if !c.Args().Present() {
+		archive.print()
+		return nil
+	}
+
+	dockerClient, err := newDockerClient(dockerCredentials)
+	if err != nil {
+		return err
+	}
+	client := &CustomDockerClient{
+		Client: dockerClient,
+	}
+	handleSignals()
+
+	var lastError error
+	for _, name := range c.Args() {
+		if isShuttingDown() {
+			break
+		}
+		if c.Bool("pull") {
+			err := pullImage(client, name)
+			if err == nil {
+				logrus.Infoln("Pulled", name)
+				continue
+			}
+			logrus.Warningln("Failed to pull", name, "restoring it from the archive:", err)
+		}
+
+		err := archive.Restore(client, name)
+		if err != nil {
+			logrus.Errorln("Failed to restore", name, err)
+			lastError = err
+		}
+	}
+	return lastError
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+func (s *CleanupSuite) openTestImageArchive(c *C, maxSize, minSize int64) string {
+	dir := c.MkDir()
+	archive, err := openImageArchive(dir, maxSize, minSize)
+	c.Assert(err, IsNil)
+	imageArchive = archive
+	return dir
+}
+
+func (s *CleanupSuite) TestImageIsArchivedBeforeRemoval(c *C) {
+	dir := s.openTestImageArchive(c, 1000, 10)
+	image := makeDockerImageWithSize("ruby:2.3", 100)
+	s.dockerClient.images = []APIImages{image}
+
+	_, err := removeImage(s.dockerClient, image)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.exportedImages, DeepEquals, []string{"ruby:2.3"})
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"ruby:2.3"})
+	c.Assert(imageArchive.entries, HasLen, 1)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, imageArchive.entries[0].File))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "ruby:2.3")
+
+	archive, err := openImageArchive(dir, 1000, 10)
+	c.Assert(err, IsNil)
+	c.Assert(archive.entries, HasLen, 1)
+	c.Assert(archive.entries[0].Tags, DeepEquals, []string{"ruby:2.3"})
+}
+
+func (s *CleanupSuite) TestSmallAndUntaggedImagesAreNotArchived(c *C) {
+	s.openTestImageArchive(c, 1000, 10)
+
+	_, err := removeImage(s.dockerClient, makeDockerImageWithSize("small", 1))
+	c.Assert(err, IsNil)
+	_, err = removeImage(s.dockerClient, APIImages{ID: "untagged", RepoTags: []string{untaggedImage}, Size: 100})
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.exportedImages, HasLen, 0)
+	c.Assert(s.dockerClient.removedImages, HasLen, 2)
+}
+
+func (s *CleanupSuite) TestArchiveEvictsLeastRecentlyUsed(c *C) {
+	s.openTestImageArchive(c, 20, 0)
+
+	err := imageArchive.Archive(s.dockerClient, makeDockerImageWithSize("first", 1))
+	c.Assert(err, IsNil)
+	err = imageArchive.Archive(s.dockerClient, makeDockerImageWithSize("second", 1))
+	c.Assert(err, IsNil)
+	imageArchive.entries[imageArchive.find("first")].Used = time.Now().Add(time.Hour)
+
+	err = imageArchive.Archive(s.dockerClient, makeDockerImageWithSize("third-image", 1))
+	c.Assert(err, IsNil)
+	c.Assert(imageArchive.find("first"), Not(Equals), -1)
+	c.Assert(imageArchive.find("second"), Equals, -1)
+	c.Assert(imageArchive.find("third-image"), Not(Equals), -1)
+	c.Assert(imageArchive.size() <= 20, Equals, true)
+}
+
+func (s *CleanupSuite) TestRestoreArchivedImage(c *C) {
+	s.openTestImageArchive(c, 1000, 0)
+
+	err := imageArchive.Archive(s.dockerClient, makeDockerImageWithSize("ruby:2.3", 100))
+	c.Assert(err, IsNil)
+
+	err = imageArchive.Restore(s.dockerClient, "ruby:2.3")
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.loadedImages, DeepEquals, []string{"ruby:2.3"})
+
+	err = imageArchive.Restore(s.dockerClient, "unknown")
+	c.Assert(err, NotNil)
+}
+
+func (s *CleanupSuite) TestReferencedImagesAreRestored(c *C) {
+	s.openTestImageArchive(c, 1000, 0)
+	opts.ArchiveAutoRestore = true
+
+	err := imageArchive.Archive(s.dockerClient, makeDockerImageWithSize("ruby:2.3", 100))
+	c.Assert(err, IsNil)
+	err = imageArchive.Archive(s.dockerClient, makeDockerImageWithSize("alpine:3.4", 100))
+	c.Assert(err, IsNil)
+	err = imageArchive.Archive(s.dockerClient, makeDockerImageWithSize("node:8", 100))
+	c.Assert(err, IsNil)
+	imagesUsed["alpine"] = ImageInfo{APIImages: makeDockerImage("alpine:3.4")}
+	running := State{Running: true}
+	inspectedContainers["build"] = &Container{ID: "build", State: running, Config: &Config{Image: "ruby:2.3"}}
+	inspectedContainers["service"] = &Container{ID: "service", State: running, Config: &Config{Image: "alpine:3.4"}}
+	inspectedContainers["stopped"] = &Container{ID: "stopped", Config: &Config{Image: "node:8"}}
+	inspectedContainers["other"] = &Container{ID: "other", State: running, Config: &Config{Image: "node"}}
+
+	imageArchive.RestoreReferenced(s.dockerClient, DiskSpace{BytesFree: 1000}, 995)
+	c.Assert(s.dockerClient.loadedImages, HasLen, 0)
+
+	imageArchive.RestoreReferenced(s.dockerClient, DiskSpace{BytesFree: 1000}, 100)
+	c.Assert(s.dockerClient.loadedImages, DeepEquals, []string{"ruby:2.3"})
+
+	s.dockerClient.loadedImages = nil
+	imageArchive.RestoreReferenced(s.dockerClient, DiskSpace{BytesFree: 1000}, 100)
+	c.Assert(s.dockerClient.loadedImages, HasLen, 0)
+}
+
+func (s *CleanupSuite) TestRemovedImageIsNotRestoredByItsStoppedContainer(c *C) {
+	s.openTestImageArchive(c, humanize.GByte, 0)
+	opts.ArchiveAutoRestore = true
+	opts.MaxImageAge = time.Hour
+
+	s.dockerClient.images = []APIImages{makeDockerImageWithSize("ruby:2.3", 100)}
+	s.dockerClient.containers = []APIContainers{makeDockerContainer("job", "ruby:2.3")}
+	s.dockerClient.freeSpace = humanize.GByte
+	s.dockerClient.freeFiles = 100000
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	image := imagesUsed["ruby:2.3"]
+	image.Used = time.Now().Add(-2 * time.Hour)
+	imagesUsed["ruby:2.3"] = image
+
+	err = enforceMaxAge(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"ruby:2.3"})
+
+	s.dockerClient.images = nil
+	err = doCycle(s.dockerClient, humanize.MByte, 2*humanize.MByte, 1000, 10000)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.loadedImages, HasLen, 0)
+}
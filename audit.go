@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AuditRecord struct {
+	Time       time.Time  `json:"time"`
+	Action     string     `json:"action"`
+	ID         string     `json:"id"`
+	Names      []string   `json:"names,omitempty"`
+	Size       int64      `json:"size"`
+	Score      int64      `json:"score"`
+	LastUsed   time.Time  `json:"last_used"`
+	Reason     string     `json:"reason"`
+	DiskBefore *DiskSpace `json:"disk_before,omitempty"`
+	DiskAfter  *DiskSpace `json:"disk_after,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type AuditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+var auditLog *AuditLog
+
+func openAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	a := &AuditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = stat.Size()
+	return nil
+}
+
+func (a *AuditLog) backupPath(index int) string {
+	return fmt.Sprintf("%s.%d", a.path, index)
+}
+
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+
+	if a.maxBackups > 0 {
+		os.Remove(a.backupPath(a.maxBackups))
+		for i := a.maxBackups - 1; i > 0; i-- {
+			os.Rename(a.backupPath(i), a.backupPath(i+1))
+		}
+		if err := os.Rename(a.path, a.backupPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *AuditLog) Write(record AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+func writeAuditRecord(record AuditRecord, removeErr error) {
+	if removeErr != nil {
+		record.Error = strings.TrimSpace(removeErr.Error())
+	}
+	if err := auditLog.Write(record); err != nil {
+		logrus.Warningln("Failed to write audit log:", err)
+	}
+}
+
+func auditImageRemoval(image ImageInfo, reason string, before, after *DiskSpace, removeErr error) {
+	writeAuditRecord(AuditRecord{
+		Action:     "remove-image",
+		ID:         image.ID,
+		Names:      image.RepoTags,
+		Size:       image.Size,
+		Score:      image.score(),
+		LastUsed:   image.Used,
+		Reason:     reason,
+		DiskBefore: before,
+		DiskAfter:  after,
+	}, removeErr)
+}
+
+// auditImageUntag records the stale tags removed from an image that is kept for its other tags
+func auditImageUntag(image ImageInfo, tags []string, reason string, before, after *DiskSpace, removeErr error) {
+	writeAuditRecord(AuditRecord{
+		Action:     "untag-image",
+		ID:         image.ID,
+		Names:      tags,
+		Score:      image.score(),
+		LastUsed:   image.Used,
+		Reason:     reason,
+		DiskBefore: before,
+		DiskAfter:  after,
+	}, removeErr)
+}
+
+func auditCacheRemoval(cache CacheInfo, reason string, before, after *DiskSpace, removeErr error) {
+	writeAuditRecord(AuditRecord{
+		Action:     "remove-cache",
+		ID:         cache.ID,
+		Names:      cache.Names,
+		Size:       cache.size(),
+		Score:      cache.score(),
+		LastUsed:   cache.Used,
+		Reason:     reason,
+		DiskBefore: before,
+		DiskAfter:  after,
+	}, removeErr)
+}
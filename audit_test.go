@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/dustin/go-humanize"
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"os"
+	"path/filepath"
+)
+
+func readAuditRecords(c *C, path string) (records []AuditRecord) {
+	file, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record AuditRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		c.Assert(err, IsNil)
+		records = append(records, record)
+	}
+	return
+}
+
+func (s *CleanupSuite) openTestAuditLog(c *C, maxSize int64, maxBackups int) string {
+	path := filepath.Join(c.MkDir(), "audit.log")
+
+	var err error
+	auditLog, err = openAuditLog(path, maxSize, maxBackups)
+	c.Assert(err, IsNil)
+	return path
+}
+
+func (s *CleanupSuite) TestAuditLogRotation(c *C) {
+	path := s.openTestAuditLog(c, 200, 2)
+
+	for i := 0; i < 10; i++ {
+		err := auditLog.Write(AuditRecord{
+			Action: "remove-image",
+			ID:     "test",
+		})
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(readAuditRecords(c, path), Not(HasLen), 0)
+	c.Assert(readAuditRecords(c, path+".1"), Not(HasLen), 0)
+	c.Assert(readAuditRecords(c, path+".2"), Not(HasLen), 0)
+
+	_, err := os.Stat(path + ".3")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *CleanupSuite) TestAuditLogRecordsRemovals(c *C) {
+	path := s.openTestAuditLog(c, 0, 0)
+
+	s.dockerClient.freeSpace = humanize.GByte
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("test", 600*humanize.MByte),
+	}
+	s.dockerClient.containers = []APIContainers{
+		makeDockerCache("1", 500*humanize.MByte),
+	}
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	err = doFreeSpace(s.dockerClient, 2*humanize.GByte, 100000)
+	c.Assert(err, IsNil)
+
+	records := readAuditRecords(c, path)
+	c.Assert(records, HasLen, 2)
+	for _, record := range records {
+		c.Assert(record.Reason, Equals, "low-disk-space")
+		c.Assert(record.Error, Equals, "")
+		c.Assert(record.DiskBefore, NotNil)
+		c.Assert(record.DiskAfter, NotNil)
+		c.Assert(record.DiskAfter.BytesFree-record.DiskBefore.BytesFree, Equals, uint64(record.Size))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Backoff doubles the delay between the reconnects up to the max retry interval,
+// half of the delay is random so the hosts don't reconnect at the same time
+type Backoff struct {
+	attempts int
+	random   *rand.Rand
+}
+
+func newBackoff() *Backoff {
+	return &Backoff{
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *Backoff) next() time.Duration {
+	delay := opts.RetryInterval
+	for i := 0; i < b.attempts; i++ {
+		if opts.MaxRetryInterval > 0 && delay >= opts.MaxRetryInterval {
+			break
+		}
+		delay *= 2
+	}
+	if opts.MaxRetryInterval > 0 && delay > opts.MaxRetryInterval {
+		delay = opts.MaxRetryInterval
+	}
+	b.attempts++
+
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(b.random.Int63n(int64(delay/2)+1))
+}
+
+func (b *Backoff) reset() {
+	b.attempts = 0
+}
+
+// checkDelay returns how long to wait after a check. The backoff is reset only once a check
+// got through to the daemon, a daemon that answers the pings but hangs on the other calls
+// keeps backing off.
+func checkDelay(reconnect *Backoff, err error) time.Duration {
+	switch {
+	case err == nil:
+		reconnect.reset()
+		return opts.CheckInterval
+	case isTransient(err):
+		// the daemon failed, not the objects, so reconnect with a backoff
+		delay := reconnect.next()
+		if isTimeout(err) {
+			logrus.Warningln("The Docker daemon didn't respond in time, reconnecting in", delay, err)
+		} else {
+			logrus.Warningln("The Docker daemon failed, reconnecting in", delay, err)
+		}
+		return delay
+	default:
+		reconnect.reset()
+		return opts.RetryInterval
+	}
+}
+
+// isTransient returns true for the errors of a daemon that can't be reached,
+// the errors returned by the daemon itself are caused by the object
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if isTimeout(err) {
+		return true
+	}
+	switch err {
+	case docker.ErrConnectionRefused, context.Canceled, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	switch err.(type) {
+	case *url.Error, net.Error:
+		return true
+	}
+	return false
+}
+
+// RemovalFailure counts the consecutive failures to remove an image or a cache
+type RemovalFailure struct {
+	Failures int
+	Last     time.Time
+}
+
+var removalFailures = make(map[string]*RemovalFailure)
+var removalFailuresLock sync.Mutex
+
+// recordRemovalResult counts the failures caused by the object,
+// a successful removal forgets the previous failures
+func recordRemovalResult(id string, err error) {
+	removalFailuresLock.Lock()
+	defer removalFailuresLock.Unlock()
+
+	if err == nil {
+		delete(removalFailures, id)
+		return
+	}
+	if isTransient(err) {
+		return
+	}
+
+	failure := removalFailures[id]
+	if failure == nil {
+		failure = &RemovalFailure{}
+		removalFailures[id] = failure
+	}
+	failure.Failures++
+	failure.Last = time.Now()
+	if opts.MaxRemovalFailures > 0 && failure.Failures >= opts.MaxRemovalFailures {
+		logrus.WithField("object", id).Warningln("Failed to remove", id, failure.Failures, "times in a row,",
+			"skipping it for", opts.RemovalFailureCooldown)
+	}
+}
+
+// removalBlocked returns true for the objects that failed to be removed too many times,
+// they are tried again once after the cooldown
+func removalBlocked(id string) bool {
+	if opts.MaxRemovalFailures <= 0 {
+		return false
+	}
+
+	removalFailuresLock.Lock()
+	defer removalFailuresLock.Unlock()
+
+	failure, ok := removalFailures[id]
+	return ok && failure.Failures >= opts.MaxRemovalFailures && time.Since(failure.Last) < opts.RemovalFailureCooldown
+}
+
+// pruneRemovalFailures forgets the failures of the images and the caches that are gone
+func pruneRemovalFailures() {
+	removalFailuresLock.Lock()
+	defer removalFailuresLock.Unlock()
+
+	for id := range removalFailures {
+		_, image := imagesUsed[id]
+		_, cache := cachesUsed[id]
+		if !image && !cache {
+			delete(removalFailures, id)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"net/url"
+	"time"
+)
+
+func (s *CleanupSuite) TestBackoff(c *C) {
+	backoff := newBackoff()
+	for _, expected := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		delay := backoff.next()
+		c.Assert(delay >= expected/2 && delay <= expected, Equals, true, Commentf("%v not within %v", delay, expected))
+	}
+
+	backoff.reset()
+	c.Assert(backoff.next() <= opts.RetryInterval, Equals, true)
+}
+
+func (s *CleanupSuite) TestTransientErrors(c *C) {
+	c.Assert(isTransient(nil), Equals, false)
+	c.Assert(isTransient(ErrConnectionRefused), Equals, true)
+	c.Assert(isTransient(&TimeoutError{Call: "Ping", Timeout: time.Second}), Equals, true)
+	c.Assert(isTransient(&url.Error{Op: "Get", URL: "http://docker", Err: errors.New("broken pipe")}), Equals, true)
+	c.Assert(isTransient(&Error{Status: 409, Message: "image is being used"}), Equals, false)
+	c.Assert(isTransient(errNothingToDelete), Equals, false)
+}
+
+func (s *CleanupSuite) TestRemovalFailuresBlockObject(c *C) {
+	failure := &Error{Status: 409, Message: "conflict"}
+	recordRemovalResult("image", failure)
+	recordRemovalResult("image", ErrConnectionRefused)
+	recordRemovalResult("image", failure)
+	c.Assert(removalBlocked("image"), Equals, false)
+
+	recordRemovalResult("image", failure)
+	c.Assert(removalBlocked("image"), Equals, true)
+
+	removalFailures["image"].Last = time.Now().Add(-opts.RemovalFailureCooldown)
+	c.Assert(removalBlocked("image"), Equals, false)
+
+	recordRemovalResult("image", nil)
+	c.Assert(removalFailures, HasLen, 0)
+}
+
+func (s *CleanupSuite) TestBlockedImageIsSkipped(c *C) {
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("image1", 100),
+		makeDockerImageWithSize("image2", 100),
+	}
+	s.dockerClient.freeFiles = 1000
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	removalFailures["image1"] = &RemovalFailure{
+		Failures: opts.MaxRemovalFailures,
+		Last:     time.Now(),
+	}
+
+	err = doFreeSpace(s.dockerClient, 1000, 0)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"image2"})
+
+	delete(imagesUsed, "image1")
+	pruneRemovalFailures()
+	c.Assert(removalFailures, HasLen, 0)
+}
+
+func (s *CleanupSuite) TestCheckDelayBacksOffHungDaemon(c *C) {
+	reconnect := newBackoff()
+	timeout := &TimeoutError{Call: "ListImages", Timeout: time.Minute}
+
+	c.Assert(checkDelay(reconnect, timeout) <= opts.RetryInterval, Equals, true)
+	c.Assert(checkDelay(reconnect, timeout) >= opts.RetryInterval, Equals, true)
+	c.Assert(checkDelay(reconnect, timeout) >= 2*opts.RetryInterval, Equals, true)
+
+	c.Assert(checkDelay(reconnect, errNothingToDelete), Equals, opts.RetryInterval)
+	c.Assert(checkDelay(reconnect, timeout) <= opts.RetryInterval, Equals, true)
+
+	checkDelay(reconnect, timeout)
+	c.Assert(checkDelay(reconnect, nil), Equals, opts.CheckInterval)
+	c.Assert(reconnect.attempts, Equals, 0)
+}
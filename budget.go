@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+var errBudgetExhausted = errors.New("cleanup budget of the check exhausted")
+
+// CycleBudget limits the removals of a single check,
+// so a big backlog is removed over several checks
+type CycleBudget struct {
+	lock     sync.Mutex
+	started  time.Time
+	removals int
+	bytes    uint64
+}
+
+var cycleBudget *CycleBudget
+var maxBytesPerCycle uint64
+
+func newCycleBudget() *CycleBudget {
+	return &CycleBudget{
+		started: time.Now(),
+	}
+}
+
+func (b *CycleBudget) exhausted() string {
+	if b == nil {
+		return ""
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if opts.MaxRemovalsPerCycle > 0 && b.removals >= opts.MaxRemovalsPerCycle {
+		return "removed " + humanize.Comma(int64(b.removals)) + " objects"
+	}
+	if maxBytesPerCycle > 0 && b.bytes >= maxBytesPerCycle {
+		return "removed " + humanize.Bytes(b.bytes)
+	}
+	if opts.MaxCycleTime > 0 && time.Since(b.started) >= opts.MaxCycleTime {
+		return "spent " + time.Since(b.started).String()
+	}
+	return ""
+}
+
+// allow returns false once the budget is exhausted or the tool is shutting down
+func (b *CycleBudget) allow() bool {
+	if isShuttingDown() {
+		logrus.Infoln("Shutting down, no more removals in this check")
+		return false
+	}
+	reason := b.exhausted()
+	if reason != "" {
+		logrus.Infoln("Cleanup budget exhausted,", reason, "in this check, continuing in the next one")
+		return false
+	}
+	return true
+}
+
+// spend accounts a removal and waits the delay between the removals
+func (b *CycleBudget) spend(bytes int64) {
+	b.reserve(bytes)
+	b.wait()
+}
+
+// reserve accounts a removal before it runs
+func (b *CycleBudget) reserve(bytes int64) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.removals++
+	if bytes > 0 {
+		b.bytes += uint64(bytes)
+	}
+}
+
+func (b *CycleBudget) wait() {
+	if opts.RemovalDelay > 0 {
+		time.Sleep(opts.RemovalDelay)
+	}
+}
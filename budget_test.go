@@ -0,0 +1,61 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (s *CleanupSuite) TestCycleBudgetLimitsRemovals(c *C) {
+	opts.MaxRemovalsPerCycle = 2
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("image1", 100),
+		makeDockerImageWithSize("image2", 100),
+		makeDockerImageWithSize("image3", 100),
+	}
+	s.dockerClient.freeFiles = 1000
+
+	err := doCycle(s.dockerClient, 1000, 2000, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, HasLen, 2)
+
+	s.dockerClient.images = s.dockerClient.images[2:]
+	err = doCycle(s.dockerClient, 1000, 2000, 0, 0)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedImages, HasLen, 3)
+}
+
+func (s *CleanupSuite) TestCycleBudgetLimitsBytes(c *C) {
+	maxBytesPerCycle = 150
+	cycleBudget = newCycleBudget()
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("image1", 100),
+		makeDockerImageWithSize("image2", 100),
+		makeDockerImageWithSize("image3", 100),
+	}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	err = doFreeSpace(s.dockerClient, 1000, 0)
+	c.Assert(err, Equals, errBudgetExhausted)
+	c.Assert(s.dockerClient.removedImages, HasLen, 2)
+}
+
+func (s *CleanupSuite) TestCycleBudgetLimitsTime(c *C) {
+	opts.MaxCycleTime = time.Minute
+	budget := newCycleBudget()
+	c.Assert(budget.allow(), Equals, true)
+
+	budget.started = time.Now().Add(-2 * time.Minute)
+	c.Assert(budget.allow(), Equals, false)
+
+	var unlimited *CycleBudget
+	c.Assert(unlimited.allow(), Equals, true)
+}
+
+func (s *CleanupSuite) TestRemovalDelay(c *C) {
+	opts.RemovalDelay = 10 * time.Millisecond
+	started := time.Now()
+	cycleBudget.spend(0)
+	c.Assert(time.Since(started) >= opts.RemovalDelay, Equals, true)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cacheNameRegexp matches the names of the cache containers and volumes
+// created by GitLab Runner:
+//
+//	runner-<token>-project-<id>-concurrent-<id>-cache-<md5 of path>
+//	runner-<token>-project-<id>-concurrent-<id>-<key>-cache-<md5 of path>-protected
+var cacheNameRegexp = regexp.MustCompile(`^/?runner-([0-9A-Za-z_-]{8,9})-project-(\d+)-concurrent-(\d+)(?:-([0-9a-f]+))?-cache-([0-9a-f]{32})(?:-(protected|non_protected))?$`)
+
+type CacheName struct {
+	RunnerToken  string
+	ProjectID    int64
+	ConcurrentID int
+	Key          string
+	PathHash     string
+	Protection   string
+}
+
+func parseCacheName(name string) (cacheName CacheName, ok bool) {
+	match := cacheNameRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return
+	}
+
+	projectID, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return
+	}
+	concurrentID, err := strconv.Atoi(match[3])
+	if err != nil {
+		return
+	}
+
+	cacheName = CacheName{
+		RunnerToken:  match[1],
+		ProjectID:    projectID,
+		ConcurrentID: concurrentID,
+		Key:          match[4],
+		PathHash:     match[5],
+		Protection:   match[6],
+	}
+	return cacheName, true
+}
+
+func parseCacheNames(names ...string) (CacheName, bool) {
+	for _, name := range names {
+		if cacheName, ok := parseCacheName(name); ok {
+			return cacheName, true
+		}
+	}
+	return CacheName{}, false
+}
+
+func (n CacheName) String() string {
+	name := fmt.Sprintf("runner-%s-project-%d-concurrent-%d", n.RunnerToken, n.ProjectID, n.ConcurrentID)
+	if n.Key != "" {
+		name += "-" + n.Key
+	}
+	name += "-cache-" + n.PathHash
+	if n.Protection != "" {
+		name += "-" + n.Protection
+	}
+	return name
+}
+
+func (n CacheName) fields() logrus.Fields {
+	return logrus.Fields{
+		"runner":        n.RunnerToken,
+		"project_id":    n.ProjectID,
+		"concurrent_id": n.ConcurrentID,
+		"path_hash":     n.PathHash,
+	}
+}
+
+func parseProjectIDs(projects string) (map[int64]bool, error) {
+	if projects == "" {
+		return nil, nil
+	}
+
+	ids := make(map[int64]bool)
+	for _, project := range strings.Split(projects, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(project), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid project ID %q", project)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+var protectedCacheProjects map[int64]bool
+
+func isProtectedCache(cacheName CacheName) bool {
+	return protectedCacheProjects[cacheName.ProjectID]
+}
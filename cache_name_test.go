@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+)
+
+func (s *CleanupSuite) TestParseCacheName(c *C) {
+	name, ok := parseCacheName("/runner-abcd1234-project-42-concurrent-3-cache-3c3f060a0374fc8bc39395164f415a70")
+	c.Assert(ok, Equals, true)
+	c.Assert(name, DeepEquals, CacheName{
+		RunnerToken:  "abcd1234",
+		ProjectID:    42,
+		ConcurrentID: 3,
+		PathHash:     "3c3f060a0374fc8bc39395164f415a70",
+	})
+	c.Assert(name.String(), Equals, "runner-abcd1234-project-42-concurrent-3-cache-3c3f060a0374fc8bc39395164f415a70")
+
+	name, ok = parseCacheName("runner-123456789-project-7-concurrent-0-0123abcd-cache-3c3f060a0374fc8bc39395164f415a70-protected")
+	c.Assert(ok, Equals, true)
+	c.Assert(name.RunnerToken, Equals, "123456789")
+	c.Assert(name.Key, Equals, "0123abcd")
+	c.Assert(name.Protection, Equals, "protected")
+	c.Assert(name.String(), Equals, "runner-123456789-project-7-concurrent-0-0123abcd-cache-3c3f060a0374fc8bc39395164f415a70-protected")
+
+	for _, invalid := range []string{
+		"runner-abcd1234-project-42-concurrent-3-build",
+		"runner-abcd1234-project-x-concurrent-3-cache-3c3f060a0374fc8bc39395164f415a70",
+		"runner-abcd1234-project-42-concurrent-3-cache-mycache",
+		"my-runner-abcd1234-project-42-concurrent-3-cache-3c3f060a0374fc8bc39395164f415a70",
+		"runner-abcd1234-project-42-concurrent-3-cache-3c3f060a0374fc8bc39395164f415a70-backup",
+	} {
+		_, ok = parseCacheName(invalid)
+		c.Assert(ok, Equals, false, Commentf("%s", invalid))
+	}
+}
+
+func (s *CleanupSuite) TestParseProjectIDs(c *C) {
+	ids, err := parseProjectIDs("")
+	c.Assert(err, IsNil)
+	c.Assert(ids, IsNil)
+
+	ids, err = parseProjectIDs("1, 42")
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, map[int64]bool{1: true, 42: true})
+
+	_, err = parseProjectIDs("1,project")
+	c.Assert(err, NotNil)
+}
+
+func (s *CleanupSuite) TestVolumeCaches(c *C) {
+	volumeName := makeDockerCacheName(1, "volume")
+	s.dockerClient.volumes = []Volume{
+		{Name: volumeName},
+		{Name: "my-volume"},
+	}
+	s.dockerClient.containers = []APIContainers{
+		makeDockerContainer("build", "image"),
+	}
+	s.dockerClient.mounts = []Mount{
+		{Name: volumeName, Destination: "/cache"},
+	}
+
+	err := updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(cachesUsed, HasLen, 1)
+	c.Assert(cachesUsed[volumeName].Volume, Equals, true)
+	c.Assert(cachesUsed[volumeName].Name.ProjectID, Equals, int64(1))
+
+	cacheUsed := cachesUsed[volumeName]
+	handleDockerContainerID(s.dockerClient, "build")
+	c.Assert(cachesUsed[volumeName].ObjectTTL, Not(DeepEquals), cacheUsed.ObjectTTL)
+
+	s.dockerClient.freeSpace = humanize.GByte
+	err = doFreeSpace(s.dockerClient, 2*humanize.GByte, 100000)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedVolumes, DeepEquals, []string{volumeName})
+	c.Assert(s.dockerClient.removedContainers, HasLen, 0)
+}
+
+func (s *CleanupSuite) TestProtectedCacheProjects(c *C) {
+	s.dockerClient.freeSpace = humanize.GByte
+	s.dockerClient.containers = []APIContainers{
+		makeDockerContainerWithSize(makeDockerCacheName(1, "1"), "cache", 600*humanize.MByte),
+		makeDockerContainerWithSize(makeDockerCacheName(2, "2"), "cache", 500*humanize.MByte),
+	}
+	protectedCacheProjects = map[int64]bool{2: true}
+
+	err := updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	err = doFreeSpace(s.dockerClient, 2*humanize.GByte, 100000)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedContainers, DeepEquals, []string{makeDockerCacheName(1, "1")})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/dustin/go-humanize"
@@ -21,6 +22,7 @@ import (
 
 const objectPastTimeDivisor = time.Second
 const danglingImageBonus = 1000
+const mirroredImageBonus = 500
 const spaceAllFree uint64 = ^uint64(0)
 const dockerClientEndpoint = "unix:///var/run/docker.sock"
 
@@ -31,11 +33,12 @@ var initInternalImages = []string{
 	"gitlab/gitlab-runner:*",
 	"quay.io/gitlab-runner:*",
 	"quay.io/gitlab-runner-*:*",
-	"gitlab/gitlab-runner-helper:*",
 }
 
 var diskSpaceImage = "alpine"
 
+var errNothingToDelete = errors.New("no images or caches to delete")
+
 var opts = struct {
 	MonitorPath                      string        `long:"check-path" description:"Path to monitor when verifying disk space" env:"CHECK_PATH"`
 	LowFreeSpace                     string        `long:"low-free-space" description:"When to trigger cleanup cycle" env:"LOW_FREE_SPACE"`
@@ -47,6 +50,61 @@ var opts = struct {
 	RetryInterval                    time.Duration `long:"retry-interval" description:"How long to wait before trying again?" env:"RETRY_INTERVAL"`
 	DefaultTTL                       time.Duration `long:"ttl" description:"Default minimum TTL for caches and images" env:"DEFAULT_TTL"`
 	AdditionalInternalImagesFilePath string        `long:"additional-internal-images-file-path" description:"User defined images not to remove" env:"ADDITIONAL_INTERNAL_IMAGES_FILE_PATH"`
+	AuditLogPath                     string        `long:"audit-log" description:"Append a JSON record of every removal to this file" env:"AUDIT_LOG"`
+	AuditLogMaxSize                  string        `long:"audit-log-max-size" description:"Rotate the audit log when it grows above this size" env:"AUDIT_LOG_MAX_SIZE"`
+	AuditLogMaxBackups               int           `long:"audit-log-max-backups" description:"How many rotated audit logs to keep" env:"AUDIT_LOG_MAX_BACKUPS"`
+	LogLevel                         string        `long:"log-level" description:"Log level (debug, info, warning, error)" env:"LOG_LEVEL"`
+	LogFormat                        string        `long:"log-format" description:"Log format (text, json)" env:"LOG_FORMAT"`
+	WebhookURL                       string        `long:"webhook-url" description:"URL to POST cleanup notifications to" env:"WEBHOOK_URL"`
+	WebhookFormat                    string        `long:"webhook-format" description:"Webhook payload format (generic, slack)" env:"WEBHOOK_FORMAT"`
+	WebhookTemplate                  string        `long:"webhook-template" description:"Go template used to render the notification text" env:"WEBHOOK_TEMPLATE"`
+	WebhookEvents                    string        `long:"webhook-events" description:"Comma separated list of events to notify about, all when empty" env:"WEBHOOK_EVENTS"`
+	WebhookRateLimit                 time.Duration `long:"webhook-rate-limit" description:"Minimum time between two notifications of the same event" env:"WEBHOOK_RATE_LIMIT"`
+	WebhookRetries                   int           `long:"webhook-retries" description:"How many times to retry a failed notification" env:"WEBHOOK_RETRIES"`
+	DaemonUnreachableTimeout         time.Duration `long:"daemon-unreachable-timeout" description:"Notify when the docker daemon is unreachable for longer than this" env:"DAEMON_UNREACHABLE_TIMEOUT"`
+	PauseRunner                      string        `long:"pause-runner" description:"Pause the runner when the free space can't be recovered (api, config)" env:"PAUSE_RUNNER"`
+	GitLabURL                        string        `long:"gitlab-url" description:"GitLab URL used to pause the runners" env:"GITLAB_URL"`
+	GitLabToken                      string        `long:"gitlab-token" description:"GitLab API token used to pause the runners" env:"GITLAB_TOKEN"`
+	RunnerIDs                        string        `long:"runner-ids" description:"Comma separated list of runner IDs to pause" env:"RUNNER_IDS"`
+	RunnerConfigFile                 string        `long:"runner-config" description:"Path to the GitLab Runner config.toml" env:"RUNNER_CONFIG"`
+	PausedConcurrent                 int           `long:"paused-concurrent" description:"The concurrent setting to use when the runner is paused via config.toml" env:"PAUSED_CONCURRENT"`
+	FreeSpacePerJob                  string        `long:"free-space-per-job" description:"Expect at least this much free space for every concurrent job of the runner" env:"FREE_SPACE_PER_JOB"`
+	RunnerVersion                    string        `long:"runner-version" description:"The installed runner version, detected from the running runner container when empty" env:"RUNNER_VERSION"`
+	HelperImageVersions              int           `long:"helper-image-versions" description:"How many previous runner versions to keep the helper images for, -1 keeps all" env:"HELPER_IMAGE_VERSIONS"`
+	ProtectedCacheProjects           string        `long:"protected-cache-projects" description:"Comma separated list of project IDs whose caches are never removed" env:"PROTECTED_CACHE_PROJECTS"`
+	CacheQuotas                      string        `long:"cache-quotas" description:"Comma separated list of <project id>:<max size>:<max count> cache quotas, * matches all projects" env:"CACHE_QUOTAS"`
+	FairCacheEviction                bool          `long:"fair-cache-eviction" description:"Remove the caches of the project using most of the cache space first" env:"FAIR_CACHE_EVICTION"`
+	StatusFile                       string        `long:"status-file" description:"Write the state of all images and caches to this file after every check" env:"STATUS_FILE"`
+	ImageHistoryRetention            time.Duration `long:"image-history-retention" description:"How long to keep the usage history of images that are gone" env:"IMAGE_HISTORY_RETENTION"`
+	ThrashWindow                     time.Duration `long:"thrash-window" description:"An image pulled again within this time after being removed is thrashing" env:"THRASH_WINDOW"`
+	ThrashTTL                        time.Duration `long:"thrash-ttl" description:"Additional TTL given to a thrashing image for every time it was pulled again" env:"THRASH_TTL"`
+	ArchiveDir                       string        `long:"archive-dir" description:"Save the images to this directory before removing them" env:"ARCHIVE_DIR"`
+	ArchiveMaxSize                   string        `long:"archive-max-size" description:"The size budget of the archive, the least recently used images are removed first" env:"ARCHIVE_MAX_SIZE"`
+	ArchiveMinSize                   string        `long:"archive-min-size" description:"Only archive images at least this big" env:"ARCHIVE_MIN_SIZE"`
+	MirrorRegistry                   string        `long:"mirror-registry" description:"Push the images to this registry before removing them" env:"MIRROR_REGISTRY"`
+	TagRetention                     string        `long:"tag-retention" description:"Comma separated list of <repository pattern>=<keep>[:<order>] rules keeping only the last tags of a repository" env:"TAG_RETENTION"`
+	MaxImageAge                      time.Duration `long:"max-image-age" description:"Remove the images unused for longer than this on every check, 0 disables it" env:"MAX_IMAGE_AGE"`
+	MaxCacheAge                      time.Duration `long:"max-cache-age" description:"Remove the caches unused for longer than this on every check, 0 disables it" env:"MAX_CACHE_AGE"`
+	DeepCleanSchedule                string        `long:"deep-clean-schedule" description:"Cron schedule of the deep clean freeing the disk space regardless of the lower bound" env:"DEEP_CLEAN_SCHEDULE"`
+	DeepCleanFreeSpace               string        `long:"deep-clean-free-space" description:"How much free space the deep clean tries to reach, the expected free space when empty" env:"DEEP_CLEAN_FREE_SPACE"`
+	QuietHours                       string        `long:"quiet-hours" description:"Cron expression of the minutes during which only the critical cleanup runs" env:"QUIET_HOURS"`
+	CriticalFreeSpace                string        `long:"critical-free-space" description:"The free space below which the cleanup runs even during the quiet hours, half of the lower bound when empty" env:"CRITICAL_FREE_SPACE"`
+	WaitForIdle                      bool          `long:"wait-for-idle" description:"Defer the non-critical cleanup while build containers are running" env:"WAIT_FOR_IDLE"`
+	MaxIdleWait                      time.Duration `long:"max-idle-wait" description:"The longest time to defer the cleanup waiting for the builds to finish" env:"MAX_IDLE_WAIT"`
+	MaxRemovalsPerCycle              int           `long:"max-removals-per-cycle" description:"Remove at most this many images and caches in a single check, 0 is unlimited" env:"MAX_REMOVALS_PER_CYCLE"`
+	MaxBytesPerCycle                 string        `long:"max-bytes-per-cycle" description:"Remove at most this much data in a single check, unlimited when empty" env:"MAX_BYTES_PER_CYCLE"`
+	MaxCycleTime                     time.Duration `long:"max-cycle-time" description:"Stop removing after this time in a single check, 0 is unlimited" env:"MAX_CYCLE_TIME"`
+	RemovalDelay                     time.Duration `long:"removal-delay" description:"How long to wait between two removals" env:"REMOVAL_DELAY"`
+	InspectWorkers                   int           `long:"inspect-workers" description:"How many containers to inspect at the same time" env:"INSPECT_WORKERS"`
+	RemovalWorkers                   int           `long:"removal-workers" description:"How many images and caches to remove at the same time" env:"REMOVAL_WORKERS"`
+	DockerTimeout                    time.Duration `long:"docker-timeout" description:"How long to wait for a Docker API call, 0 waits forever" env:"DOCKER_TIMEOUT"`
+	DockerTransferTimeout            time.Duration `long:"docker-transfer-timeout" description:"How long to wait for a Docker image export, load, pull or push, 0 waits forever" env:"DOCKER_TRANSFER_TIMEOUT"`
+	StateFile                        string        `long:"state-file" description:"Keep the usage of the images and caches in this file across restarts" env:"STATE_FILE"`
+	MaxRetryInterval                 time.Duration `long:"max-retry-interval" description:"The longest time to wait before reconnecting to the daemon, the wait doubles from the retry interval" env:"MAX_RETRY_INTERVAL"`
+	MaxRemovalFailures               int           `long:"max-removal-failures" description:"Skip the images and caches that failed to be removed this many times in a row, 0 disables it" env:"MAX_REMOVAL_FAILURES"`
+	RemovalFailureCooldown           time.Duration `long:"removal-failure-cooldown" description:"How long to skip the images and caches that repeatedly failed to be removed" env:"REMOVAL_FAILURE_COOLDOWN"`
+	ArchiveAutoRestore               bool          `long:"archive-auto-restore" description:"Load the archived images again when running containers still refer to their missing tags" env:"ARCHIVE_AUTO_RESTORE"`
+	CacheMeasureInterval             time.Duration `long:"cache-measure-interval" description:"Measure the volumes of a cache used since its last measurement at most this often" env:"CACHE_MEASURE_INTERVAL"`
 }{
 	"/",
 	"1GB",
@@ -58,6 +116,61 @@ var opts = struct {
 	30 * time.Second,
 	1 * time.Minute,
 	"/etc/gitlab_runner_docker_cleanup_internal_images",
+	"",
+	"100MB",
+	5,
+	"info",
+	"text",
+	"",
+	"generic",
+	"",
+	"",
+	15 * time.Minute,
+	3,
+	5 * time.Minute,
+	"",
+	"https://gitlab.com/",
+	"",
+	"",
+	"",
+	1,
+	"",
+	"",
+	1,
+	"",
+	"",
+	false,
+	"",
+	7 * 24 * time.Hour,
+	1 * time.Hour,
+	1 * time.Hour,
+	"",
+	"50GB",
+	"100MB",
+	"",
+	"",
+	0,
+	0,
+	"",
+	"",
+	"",
+	"",
+	false,
+	30 * time.Minute,
+	0,
+	"",
+	0,
+	0,
+	4,
+	1,
+	1 * time.Minute,
+	30 * time.Minute,
+	"",
+	5 * time.Minute,
+	3,
+	24 * time.Hour,
+	false,
+	10 * time.Minute,
 }
 
 type DiskSpace struct {
@@ -66,13 +179,19 @@ type DiskSpace struct {
 }
 
 type DockerClient interface {
-	Ping() error
-	ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error)
-	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
-	RemoveImageExtended(name string, opts docker.RemoveImageOptions) error
-	RemoveContainer(opts docker.RemoveContainerOptions) error
-	InspectContainer(id string) (*docker.Container, error)
-	DiskSpace(path string) (DiskSpace, error)
+	Ping(ctx context.Context) error
+	ListImages(ctx context.Context, opts docker.ListImagesOptions) ([]docker.APIImages, error)
+	ListContainers(ctx context.Context, opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	RemoveImageExtended(ctx context.Context, name string, opts docker.RemoveImageOptions) error
+	RemoveContainer(ctx context.Context, opts docker.RemoveContainerOptions) error
+	ListVolumes(ctx context.Context, opts docker.ListVolumesOptions) ([]docker.Volume, error)
+	RemoveVolume(ctx context.Context, name string) error
+	ExportImages(ctx context.Context, opts docker.ExportImagesOptions) error
+	TagImage(ctx context.Context, name string, opts docker.TagImageOptions) error
+	PushImage(ctx context.Context, opts docker.PushImageOptions, auth docker.AuthConfiguration) error
+	LoadImage(ctx context.Context, opts docker.LoadImageOptions) error
+	InspectContainer(ctx context.Context, id string) (*docker.Container, error)
+	DiskSpace(ctx context.Context, path string) (DiskSpace, error)
 }
 
 type CustomDockerClient struct {
@@ -96,6 +215,9 @@ func (u *ObjectTTL) score() int64 {
 type ImageInfo struct {
 	docker.APIImages
 	ObjectTTL
+	LastJob  RunnerLabels
+	Mirrored bool
+	Tags     map[string]ObjectTTL
 }
 
 func (i *ImageInfo) score() int64 {
@@ -103,12 +225,29 @@ func (i *ImageInfo) score() int64 {
 	if s > 0 && len(i.RepoTags) == 0 {
 		s += danglingImageBonus
 	}
+	if s > 0 && i.Mirrored {
+		s += mirroredImageBonus
+	}
+	if s > 0 {
+		s /= 1 + i.thrashes()
+	}
 	return s
 }
 
 type CacheInfo struct {
 	docker.APIContainers
 	ObjectTTL
+	Name     CacheName
+	Volume   bool
+	Size     int64
+	Measured time.Time
+}
+
+func (c *CacheInfo) size() int64 {
+	if c.Size > 0 {
+		return c.Size
+	}
+	return c.SizeRw
 }
 
 var dockerCredentials docker_helpers.DockerCredentials
@@ -129,52 +268,72 @@ func (c *CustomDockerClient) diskSpaceLocally(path string) (ds DiskSpace, err er
 	return
 }
 
-func (c *CustomDockerClient) diskSpaceRemotely(path string) (ds DiskSpace, err error) {
-	_, err = c.InspectImage(diskSpaceImage)
-	if err != nil {
-		logrus.Debugln("Pulling", diskSpaceImage, "...")
-		err = c.PullImage(docker.PullImageOptions{
-			Repository: diskSpaceImage,
-		}, docker.AuthConfiguration{})
-		if err != nil {
-			return
-		}
-	}
+func (c *CustomDockerClient) createContainer(ctx context.Context, options docker.CreateContainerOptions) (container *docker.Container, err error) {
+	err = withTimeout(ctx, "CreateContainer", opts.DockerTimeout, func(ctx context.Context) (err error) {
+		options.Context = ctx
+		container, err = c.Client.CreateContainer(options)
+		return
+	})
+	return
+}
 
-	// create container for the first time
-	container, err := c.CreateContainer(docker.CreateContainerOptions{
+func (c *CustomDockerClient) diskSpaceRemotely(ctx context.Context, path string) (ds DiskSpace, err error) {
+	options := docker.CreateContainerOptions{
 		Config: &docker.Config{
 			Image:        diskSpaceImage,
 			Entrypoint:   []string{"/bin/stat"},
 			Cmd:          []string{"-f", "-c%a %b %s %d %c", path},
 			AttachStdout: true,
 		},
-	})
+	}
+
+	// create container for the first time
+	container, err := c.createContainer(ctx, options)
+	if err == docker.ErrNoSuchImage {
+		logrus.Debugln("Pulling", diskSpaceImage, "...")
+		err = c.PullImage(ctx, docker.PullImageOptions{
+			Repository: diskSpaceImage,
+		}, docker.AuthConfiguration{})
+		if err != nil {
+			return
+		}
+		container, err = c.createContainer(ctx, options)
+	}
 	if err != nil {
 		return
 	}
 
-	defer c.RemoveContainer(docker.RemoveContainerOptions{
+	// the container is removed even when the check is cancelled
+	defer c.RemoveContainer(context.Background(), docker.RemoveContainerOptions{
 		ID:    container.ID,
 		Force: true,
 	})
 
-	err = c.StartContainer(container.ID, nil)
+	err = withTimeout(ctx, "StartContainer", opts.DockerTimeout, func(ctx context.Context) error {
+		return c.Client.StartContainerWithContext(container.ID, nil, ctx)
+	})
 	if err != nil {
 		return
 	}
 
-	errorCode, err := c.WaitContainer(container.ID)
+	var errorCode int
+	err = withTimeout(ctx, "WaitContainer", opts.DockerTimeout, func(ctx context.Context) (err error) {
+		errorCode, err = c.Client.WaitContainerWithContext(container.ID, ctx)
+		return
+	})
 	if err != nil || errorCode != 0 {
 		return
 	}
 
 	var buffer bytes.Buffer
-	err = c.Logs(docker.LogsOptions{
-		Container:    container.ID,
-		OutputStream: &buffer,
-		Stdout:       true,
-		Tail:         "1",
+	err = withTimeout(ctx, "Logs", opts.DockerTimeout, func(ctx context.Context) error {
+		return c.Client.Logs(docker.LogsOptions{
+			Context:      ctx,
+			Container:    container.ID,
+			OutputStream: &buffer,
+			Stdout:       true,
+			Tail:         "1",
+		})
 	})
 	if err != nil {
 		return
@@ -195,64 +354,112 @@ func (c *CustomDockerClient) diskSpaceRemotely(path string) (ds DiskSpace, err e
 	return
 }
 
-func (c *CustomDockerClient) DiskSpace(path string) (DiskSpace, error) {
+func (c *CustomDockerClient) DiskSpace(ctx context.Context, path string) (DiskSpace, error) {
 	if opts.UseDf {
 		return c.diskSpaceLocally(path)
 	} else {
-		return c.diskSpaceRemotely(path)
+		return c.diskSpaceRemotely(ctx, path)
 	}
 }
 
-func isInternalImage(image docker.APIImages) bool {
-	totalInternalImages := buildInternalImagesList(opts.AdditionalInternalImagesFilePath)
+// internalTags returns the tags of the image that must not be removed
+func internalTags(image docker.APIImages) (tags []string) {
+	if isRetainedHelperImage(image) {
+		return image.RepoTags
+	}
+
+	if internalImages == nil {
+		loadInternalImages()
+	}
+	totalInternalImages := append([]string{}, internalImages...)
+	totalInternalImages = append(totalInternalImages, runnerImages...)
+	totalInternalImages = append(totalInternalImages, runnerConfig.protectedImages()...)
 	for _, tag := range image.RepoTags {
 		for _, internalImage := range totalInternalImages {
 			if matched, _ := filepath.Match(internalImage, tag); matched {
-				return true
+				tags = append(tags, tag)
+				break
 			}
 		}
 	}
-	return false
+	return
+}
+
+func isInternalImage(image docker.APIImages) bool {
+	return len(internalTags(image)) > 0
+}
+
+// internalImages is the list of the internal images read once per check
+var internalImages []string
+
+func loadInternalImages() {
+	internalImages = buildInternalImagesList(opts.AdditionalInternalImagesFilePath)
 }
 
 func buildInternalImagesList(path string) []string {
+	internalImages := append([]string{}, initInternalImages...)
 	file, err := os.Open(path)
 	if err != nil {
 		defer file.Close()
-		logrus.Infoln("No more additional internal images defined.")
+		logrus.Debugln("No more additional internal images defined.")
 	} else {
 		defer file.Close()
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
-			initInternalImages = append(initInternalImages, scanner.Text())
+			internalImages = append(internalImages, scanner.Text())
 		}
 	}
-	return initInternalImages
+	return internalImages
 }
 
-func removeImage(client DockerClient, image docker.APIImages) error {
-	err := client.RemoveImageExtended(image.ID, docker.RemoveImageOptions{
+// removeImage removes the image, or only its stale tags when other tags are retained
+func removeImage(client DockerClient, image docker.APIImages) (untagged bool, err error) {
+	imageInfo := imagesUsed[image.ID]
+	if retained, stale := imageInfo.retainedTags(); len(retained) > 0 {
+		err = untagImage(client, image, retained, stale)
+		recordRemovalResult(image.ID, err)
+		return true, err
+	}
+
+	if err := imageArchive.Archive(client, image); err != nil {
+		logrus.WithFields(imageFields(image)).Warningln("Failed to archive image:", err)
+	}
+	if !imagesUsed[image.ID].Mirrored {
+		if err := registryMirror.Push(client, image); err != nil {
+			logrus.WithFields(imageFields(image)).Warningln("Failed to push image to the mirror:", err)
+		}
+	}
+
+	err = client.RemoveImageExtended(dockerContext, image.ID, docker.RemoveImageOptions{
 		Force: true,
 	})
 	if err == nil {
-		logrus.Infoln("Removed image", image.ID, image.RepoTags)
+		logrus.WithFields(imageFields(image)).Infoln("Removed image")
+		recordImageRemoval(image, time.Now())
 	} else {
-		logrus.Warningln("Failed to remove image", image.ID, image.RepoTags, strings.TrimSpace(err.Error()))
+		logrus.WithFields(imageFields(image)).Warningln("Failed to remove image:", strings.TrimSpace(err.Error()))
 	}
-	return err
+	recordRemovalResult(image.ID, err)
+	return false, err
 }
 
-func removeCache(client DockerClient, cache docker.APIContainers) error {
-	err := client.RemoveContainer(docker.RemoveContainerOptions{
-		ID:            cache.ID,
-		RemoveVolumes: true,
-		Force:         true,
-	})
+func removeCache(client DockerClient, cache CacheInfo) error {
+	var err error
+	if cache.Volume {
+		err = client.RemoveVolume(dockerContext, cache.ID)
+	} else {
+		err = client.RemoveContainer(dockerContext, docker.RemoveContainerOptions{
+			ID:            cache.ID,
+			RemoveVolumes: true,
+			Force:         true,
+		})
+	}
 	if err == nil {
-		logrus.Infoln("Removed cache", cache.ID, cache.Names)
+		logrus.WithFields(cacheFields(cache)).Infoln("Removed cache")
 	} else {
-		logrus.Warningln("Failed to remove cache", cache.ID, cache.Names, strings.TrimSpace(err.Error()))
+		logrus.WithFields(cacheFields(cache)).Warningln("Failed to remove cache:", strings.TrimSpace(err.Error()))
 	}
+	recordRemovalResult(cache.ID, err)
 	return err
 }
 
@@ -269,120 +476,265 @@ func handleDockerImageID(client DockerClient, id string) {
 	}
 }
 
-func isCacheContainer(names ...string) bool {
+func findCacheName(names ...string) (CacheName, bool) {
 	for _, name := range names {
-		if strings.Contains(name, "runner-") &&
-			strings.Contains(name, "-project-") &&
-			strings.Contains(name, "-concurrent-") &&
-			strings.Contains(name, "-cache-") {
-			return true
+		if !runnerConfig.ownsCache(name) {
+			continue
+		}
+		if cacheName, ok := parseCacheName(name); ok {
+			return cacheName, true
+		}
+	}
+	return CacheName{}, false
+}
+
+func isCacheContainer(names ...string) bool {
+	_, ok := findCacheName(names...)
+	return ok
+}
+
+func findCaches(containers []docker.APIContainers, volumes []docker.Volume) (caches []CacheInfo) {
+	for _, container := range containers {
+		if cacheName, ok := cacheNameOf(container.Names, container.Labels); ok {
+			caches = append(caches, CacheInfo{
+				APIContainers: container,
+				Name:          cacheName,
+			})
+		}
+	}
+	for _, volume := range volumes {
+		if cacheName, ok := findCacheName(volume.Name); ok {
+			caches = append(caches, CacheInfo{
+				APIContainers: docker.APIContainers{
+					ID:    volume.Name,
+					Names: []string{volume.Name},
+					Mounts: []docker.APIMount{
+						{Name: volume.Name, Source: volume.Mountpoint},
+					},
+				},
+				Name:   cacheName,
+				Volume: true,
+			})
 		}
 	}
-	return false
+	return
+}
+
+func listCaches(client DockerClient) ([]CacheInfo, error) {
+	containers, err := client.ListContainers(dockerContext, docker.ListContainersOptions{
+		All: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	volumes, err := client.ListVolumes(dockerContext, docker.ListVolumesOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return findCaches(containers, volumes), nil
+}
+
+func markCacheUsed(id string) {
+	if cache, ok := cachesUsed[id]; ok {
+		cache.mark(opts.DefaultTTL)
+		cachesUsed[id] = cache
+	}
 }
 
-func handleDockerContainer(client DockerClient, container *docker.Container) {
-	logrus.Debugln("handleDockerContainer", container.Name, container.ID, container.Image, container.State.Running)
+// handleDockerContainer marks the image and the caches of the container as used
+// and returns the containers it shares the volumes or the network with
+func handleDockerContainer(client DockerClient, container *docker.Container) (linked []string) {
+	var labels map[string]string
+	if container.Config != nil {
+		labels = container.Config.Labels
+	}
+	names := []string{container.Name}
+
+	logrus.Debugln("handleDockerContainer", container.Name, container.ID, container.Image, container.State.Running,
+		containerType(names, labels))
 
 	handleDockerImageID(client, container.Image)
+	if container.Config != nil {
+		markImageTag(container.Image, container.Config.Image)
+	}
+	attributeImageUsage(container.Image, container.ID, labels)
 
-	if isCacheContainer(container.Name) {
-		if cache, ok := cachesUsed[container.ID]; ok {
-			cache.mark(opts.DefaultTTL)
-			cachesUsed[container.ID] = cache
-		}
-		return
+	if _, ok := cacheNameOf(names, labels); ok {
+		markCacheUsed(container.ID)
+		return nil
 	}
 
-	for _, otherContainer := range container.HostConfig.VolumesFrom {
-		handleDockerContainerID(client, otherContainer)
+	for _, mount := range container.Mounts {
+		if mount.Name != "" {
+			markCacheUsed(mount.Name)
+		}
 	}
+
+	linked = append(linked, container.HostConfig.VolumesFrom...)
 	for _, otherContainer := range container.HostConfig.Links {
 		containerAndAlias := strings.SplitN(otherContainer, ":", 2)
 		if len(containerAndAlias) < 1 {
 			continue
 		}
-		handleDockerContainerID(client, containerAndAlias[0])
+		linked = append(linked, containerAndAlias[0])
 	}
+	return linked
 }
 
 func handleDockerContainerID(client DockerClient, containerID string) {
-	container, err := client.InspectContainer(containerID)
-	if err != nil {
-		logrus.Warningln("Failed to inspect container", containerID, err)
-		return
-	}
-	handleDockerContainer(client, container)
+	inspectContainers(client, []string{containerID})
 }
 
 func updateImages(client DockerClient) error {
 	newUsed := make(map[string]ImageInfo)
 
 	// traverse all images
-	images, err := client.ListImages(docker.ListImagesOptions{
+	images, err := client.ListImages(dockerContext, docker.ListImagesOptions{
 		All: true,
 	})
 	if err != nil {
 		return err
 	}
+	now := time.Now()
 	for _, image := range images {
+		thrashed := recordImageSeen(image, now)
 		imageInfo := ImageInfo{
 			APIImages: image,
 		}
-		if imageUsed, ok := imagesUsed[image.ID]; ok {
+		if imageUsed, ok := imagesUsed[image.ID]; ok && !thrashed {
 			imageInfo.ObjectTTL = imageUsed.ObjectTTL
+			imageInfo.LastJob = imageUsed.LastJob
+			imageInfo.Mirrored = imageUsed.Mirrored || registryMirror.Contains(image)
+			imageInfo.updateTags(imageUsed.Tags, opts.DefaultTTL)
 		} else {
-			logrus.Infoln("Detected a new image", image.ID, image.RepoTags)
-			imageInfo.mark(opts.DefaultTTL)
+			logrus.WithFields(imageFields(image)).Infoln("Detected a new image")
+			imageInfo.Mirrored = registryMirror.Contains(image)
+			imageInfo.mark(opts.DefaultTTL + time.Duration(imageInfo.thrashes())*opts.ThrashTTL)
+			imageInfo.updateTags(nil, imageInfo.TTL.Sub(imageInfo.Used))
 		}
 		newUsed[image.ID] = imageInfo
 	}
 	imagesUsed = newUsed
+	pruneImageHistories(now)
 	return nil
 }
 
 func updateContainers(client DockerClient) error {
 	// traverse all running containers
-	containers, err := client.ListContainers(docker.ListContainersOptions{
+	containers, err := client.ListContainers(dockerContext, docker.ListContainersOptions{
 		All: true,
 	})
 	if err != nil {
 		return err
 	}
 
+	updateInspectedContainers(containers)
+	detectedRunnerVersion = detectRunnerVersion(containers)
+	runningBuilds = countRunningBuilds(containers)
+
+	volumes, err := client.ListVolumes(dockerContext, docker.ListVolumesOptions{})
+	if err != nil {
+		return err
+	}
+
 	newCaches := make(map[string]CacheInfo)
 
 	// detect caches
-	for _, container := range containers {
-		if !isCacheContainer(container.Names...) {
-			continue
-		}
-
-		cacheInfo := CacheInfo{
-			APIContainers: container,
-		}
-		if cacheUsed, ok := cachesUsed[container.ID]; ok {
+	for _, cacheInfo := range findCaches(containers, volumes) {
+		cacheUsed, ok := cachesUsed[cacheInfo.ID]
+		if ok {
 			cacheInfo.ObjectTTL = cacheUsed.ObjectTTL
 		} else {
-			logrus.Infoln("Detected a new cache", container.ID, container.Names)
+			logrus.WithFields(cacheFields(cacheInfo)).Infoln("Detected a new cache")
 			cacheInfo.mark(opts.DefaultTTL)
 		}
-		newCaches[container.ID] = cacheInfo
+		if cacheSizesNeeded() {
+			cacheInfo.Size, cacheInfo.Measured = cacheUsed.Size, cacheUsed.Measured
+			if cacheSizeOutdated(cacheInfo, time.Now()) {
+				cacheInfo.Size = measureCacheSize(cacheInfo)
+				cacheInfo.Measured = time.Now()
+			}
+		}
+		newCaches[cacheInfo.ID] = cacheInfo
 	}
 	cachesUsed = newCaches
 
 	// traverse all other containers to mark images and caches as used
+	var ids []string
 	for _, container := range containers {
-		if isCacheContainer(container.Names...) {
+		if _, ok := cacheNameOf(container.Names, container.Labels); ok {
 			continue
 		}
-		handleDockerContainerID(client, container.ID)
+		ids = append(ids, container.ID)
 	}
+	inspectContainers(client, ids)
 	return nil
 }
 
+// findBestCandidate returns the image or the cache with the highest score,
+// the skipped images stay in the list so their parents are not leaves
+func findBestCandidate(images []docker.APIImages, caches []CacheInfo, skipped map[string]bool) (bestImageIndex, bestCacheIndex int, bestScore int64) {
+	bestScore = -1
+	bestImageIndex = -1
+	bestCacheIndex = -1
+
+	if opts.FairCacheEviction {
+		if id, ok := fairCacheCandidate(caches); ok {
+			for idx, cache := range caches {
+				if cache.ID == id {
+					cacheInfo := cachesUsed[id]
+					return -1, idx, cacheInfo.score()
+				}
+			}
+		}
+	}
+
+	tree := newImageTree(images)
+	for idx, image := range images {
+		if isInternalImage(image) {
+			// the stale tags of an internal image can still be removed
+			imageInfo := imagesUsed[image.ID]
+			if _, stale := imageInfo.retainedTags(); len(stale) == 0 {
+				logrus.WithFields(imageFields(image)).Infoln("Internal image protected")
+				continue
+			}
+		}
+		if skipped[image.ID] || !tree.isLeaf(image.ID) || removalBlocked(image.ID) {
+			continue
+		}
+		if imageInfo, ok := imagesUsed[image.ID]; ok {
+			score := imageInfo.score()
+			if score > bestScore {
+				bestImageIndex = idx
+				bestCacheIndex = -1
+				bestScore = score
+			}
+		}
+	}
+
+	for idx, cache := range caches {
+		if isProtectedCache(cache.Name) {
+			logrus.WithFields(cacheFields(cache)).Infoln("Project cache protected")
+			continue
+		}
+		if removalBlocked(cache.ID) {
+			continue
+		}
+		if cacheInfo, ok := cachesUsed[cache.ID]; ok {
+			score := cacheInfo.score()
+			if score > bestScore {
+				bestImageIndex = -1
+				bestCacheIndex = idx
+				bestScore = score
+			}
+		}
+	}
+	return
+}
+
 func doFreeSpace(client DockerClient, freeSpace, freeFiles uint64) error {
-	images, err := client.ListImages(docker.ListImagesOptions{
+	images, err := client.ListImages(dockerContext, docker.ListImagesOptions{
 		All: true,
 	})
 	if err != nil {
@@ -390,17 +742,20 @@ func doFreeSpace(client DockerClient, freeSpace, freeFiles uint64) error {
 		return err
 	}
 
-	containers, err := client.ListContainers(docker.ListContainersOptions{
-		All: true,
-	})
+	caches, err := listCaches(client)
 	if err != nil {
-		logrus.Warningln("Failed to list containers:", err)
+		logrus.Warningln("Failed to list caches:", err)
 		return err
 	}
 
+	diskSpace, err := client.DiskSpace(dockerContext, opts.MonitorPath)
+
+	// the images in the batch stay in the list until they are removed, so their parents
+	// are not removed at the same time, the images that were only untagged stay for good
+	skipped := make(map[string]bool)
+
 	var lastError error
 	for {
-		diskSpace, err := client.DiskSpace(opts.MonitorPath)
 		if err != nil {
 			return err
 		}
@@ -408,56 +763,118 @@ func doFreeSpace(client DockerClient, freeSpace, freeFiles uint64) error {
 			break
 		}
 
-		var bestScore int64 = -1
-		bestImageIndex := -1
-		bestCacheIndex := -1
-
-		for idx, image := range images {
-			if isInternalImage(image) {
-				logrus.Infoln("Internal image protected", image.ID, image.RepoTags)
-				continue
+		// select a removal per worker until the removals are expected to free enough space,
+		// the budget is reserved before removing them
+		var batch []Removal
+		var reserved uint64
+		exhausted := false
+		for len(batch) < removalWorkers() {
+			if len(batch) > 0 && diskSpace.BytesFree+reserved > freeSpace && diskSpace.FilesFree > freeFiles {
+				break
 			}
-			if imageInfo, ok := imagesUsed[image.ID]; ok {
-				score := imageInfo.score()
-				if score > bestScore {
-					bestImageIndex = idx
-					bestCacheIndex = -1
-					bestScore = score
+			if !cycleBudget.allow() {
+				exhausted = true
+				break
+			}
+
+			bestImageIndex, bestCacheIndex, bestScore := findBestCandidate(images, caches, skipped)
+
+			logrus.WithFields(logrus.Fields{
+				"score":       bestScore,
+				"image_index": bestImageIndex,
+				"cache_index": bestCacheIndex,
+			}).Infoln("doFreeCycle")
+
+			if bestImageIndex >= 0 {
+				image := images[bestImageIndex]
+				skipped[image.ID] = true
+				imageInfo := imagesUsed[image.ID]
+				if retained, _ := imageInfo.retainedTags(); len(retained) > 0 {
+					// removing the stale tags frees no space, but counts as a removal
+					batch = append(batch, Removal{image: &image})
+					cycleBudget.reserve(0)
+					continue
 				}
+				expected := newImageTree(images).reclaimableSize(image.ID)
+				batch = append(batch, Removal{image: &image, expected: expected})
+				cycleBudget.reserve(expected)
+				reserved += uint64(expected)
+			} else if bestCacheIndex >= 0 {
+				cache := caches[bestCacheIndex]
+				cacheInfo := cachesUsed[cache.ID]
+				size := cacheInfo.size()
+				batch = append(batch, Removal{cache: &cache, expected: size})
+				cycleBudget.reserve(size)
+				if size > 0 {
+					reserved += uint64(size)
+				}
+				caches = append(caches[0:bestCacheIndex], caches[bestCacheIndex+1:len(caches)]...)
+			} else {
+				break
 			}
 		}
-
-		for idx, container := range containers {
-			if !isCacheContainer(container.Names...) {
-				continue
+		if len(batch) == 0 {
+			if exhausted {
+				return errBudgetExhausted
 			}
-			if cacheInfo, ok := cachesUsed[container.ID]; ok {
-				score := cacheInfo.score()
-				if score > bestScore {
-					bestImageIndex = -1
-					bestCacheIndex = idx
-					bestScore = score
+			lastError = errNothingToDelete
+			break
+		}
+
+		removeBatch(client, batch)
+
+		before := diskSpace
+		diskSpace, err = client.DiskSpace(dockerContext, opts.MonitorPath)
+
+		var expected int64
+		for _, removal := range batch {
+			lastError = removal.err
+			if removal.image != nil {
+				switch {
+				case removal.untagged:
+					// the image is kept for its other tags, so are its parents
+				case removal.err != nil:
+					// the parents of an image that failed to be removed can't be removed either
+					images = withoutImage(images, removal.image.ID, false)
+				default:
+					images = withoutImage(images, removal.image.ID, true)
+					expected += removal.expected
 				}
+				imageInfo := imagesUsed[removal.image.ID]
+				if removal.untagged {
+					_, stale := imageInfo.retainedTags()
+					auditImageUntag(imageInfo, stale, "low-disk-space", &before, &diskSpace, removal.err)
+				} else {
+					auditImageRemoval(imageInfo, "low-disk-space", &before, &diskSpace, removal.err)
+				}
+			} else {
+				auditCacheRemoval(cachesUsed[removal.cache.ID], "low-disk-space", &before, &diskSpace, removal.err)
 			}
 		}
 
-		logrus.Infoln("doFreeCycle", bestScore, bestImageIndex, bestCacheIndex)
-
-		if bestImageIndex >= 0 {
-			lastError = removeImage(client, images[bestImageIndex])
-			images = append(images[0:bestImageIndex], images[bestImageIndex+1:len(images)]...)
-		} else if bestCacheIndex >= 0 {
-			lastError = removeCache(client, containers[bestCacheIndex])
-			containers = append(containers[0:bestCacheIndex], containers[bestCacheIndex+1:len(containers)]...)
-		} else {
-			lastError = errors.New("no images or caches to delete")
-			break
+		if err == nil && expected > 0 {
+			var freed uint64
+			if diskSpace.BytesFree > before.BytesFree {
+				freed = diskSpace.BytesFree - before.BytesFree
+			}
+			fields := logrus.Fields{
+				"expected_bytes": expected,
+				"freed_bytes":    freed,
+			}
+			if len(batch) == 1 {
+				fields["image"] = batch[0].image.ID
+			}
+			logrus.WithFields(fields).Infoln("Expected to free", humanize.Bytes(uint64(expected)), "freed", humanize.Bytes(freed))
 		}
 	}
 	return lastError
 }
 
 func doCycle(client DockerClient, lowFreeSpace, freeSpace, lowFreeFiles, freeFiles uint64) error {
+	cycleBudget = newCycleBudget()
+	registryMirror.startCheck()
+	loadInternalImages()
+
 	err := updateImages(client)
 	if err != nil {
 		logrus.Warningln("Failed to update images:", err)
@@ -470,47 +887,149 @@ func doCycle(client DockerClient, lowFreeSpace, freeSpace, lowFreeFiles, freeFil
 		return err
 	}
 
-	diskSpace, err := client.DiskSpace(opts.MonitorPath)
+	updateHelperImages()
+	pruneRemovalFailures()
+
+	now := time.Now()
+	quiet := isQuietHours(now)
+	if quiet {
+		logrus.Debugln("Quiet hours, only freeing disk space below the critical bound")
+	} else if deferCleanup(now) {
+		logrus.Debugln(runningBuilds, "builds running, only freeing disk space below the critical bound")
+		quiet = true
+	}
+	deepClean := deepCleanDue(now)
+
+	if !quiet {
+		err = enforceCacheQuotas(client)
+		if err != nil {
+			logrus.Warningln("Failed to enforce cache quotas:", err)
+		}
+
+		err = enforceTagRetention(client)
+		if err != nil {
+			logrus.Warningln("Failed to enforce tag retention:", err)
+		}
+
+		err = enforceMaxAge(client)
+		if err != nil {
+			logrus.Warningln("Failed to remove expired images and caches:", err)
+		}
+	}
+
+	diskSpace, err := client.DiskSpace(dockerContext, opts.MonitorPath)
 	if err != nil {
 		logrus.Warningln("Failed to verify disk space:", err)
 		return err
 	}
-	if diskSpace.BytesFree >= lowFreeSpace && diskSpace.FilesFree >= lowFreeFiles {
-		if diskSpace.BytesFree >= lowFreeSpace {
+	lastDiskSpace = &diskSpace
+	resumeRunner(diskSpace, freeSpace)
+
+	triggerSpace, triggerFiles := lowFreeSpace, lowFreeFiles
+	if quiet {
+		triggerSpace, triggerFiles = criticalBounds(lowFreeSpace, lowFreeFiles)
+	} else if deepClean {
+		deepCleanPending = false
+		freeSpace = deepCleanTarget(freeSpace)
+		triggerSpace, triggerFiles = freeSpace, freeFiles
+		logrus.Infoln("Running the scheduled deep clean, trying to free up to:", humanize.Bytes(freeSpace))
+	}
+
+	if diskSpace.BytesFree >= triggerSpace && diskSpace.FilesFree >= triggerFiles {
+		if diskSpace.BytesFree >= triggerSpace {
 			logrus.Debugln("Nothing to free. Current free disk space", humanize.Bytes(diskSpace.BytesFree),
-				"is above the lower bound", humanize.Bytes(lowFreeSpace))
+				"is above the lower bound", humanize.Bytes(triggerSpace))
 		}
-		if diskSpace.FilesFree >= lowFreeFiles {
+		if diskSpace.FilesFree >= triggerFiles {
 			logrus.Debugln("Nothing to free. Current free files count", diskSpace.FilesFree,
-				"is above the lower bound", lowFreeFiles)
+				"is above the lower bound", triggerFiles)
 		}
+		imageArchive.RestoreReferenced(client, diskSpace, freeSpace)
 		return nil
 	}
 
-	if diskSpace.BytesFree < lowFreeSpace {
-		logrus.Infoln("Freeing disk space. The disk space is below the lower bound(", humanize.Bytes(lowFreeSpace), "):", humanize.Bytes(diskSpace.BytesFree),
+	if diskSpace.BytesFree < triggerSpace {
+		logrus.Infoln("Freeing disk space. The disk space is below the lower bound(", humanize.Bytes(triggerSpace), "):", humanize.Bytes(diskSpace.BytesFree),
 			"trying to free up to:", humanize.Bytes(freeSpace))
 	}
-	if diskSpace.FilesFree < lowFreeFiles {
-		logrus.Infoln("Freeing files count. The free file count is below the lower bound(", lowFreeFiles, "):", diskSpace.FilesFree,
+	if diskSpace.FilesFree < triggerFiles {
+		logrus.Infoln("Freeing files count. The free file count is below the lower bound(", triggerFiles, "):", diskSpace.FilesFree,
 			"trying to free up to:", freeFiles)
 	}
 
+	notifier.Notify(Notification{
+		Event:     eventCleanupStarted,
+		Message:   fmt.Sprintf("Cleanup started with %s free", humanize.Bytes(diskSpace.BytesFree)),
+		BytesFree: diskSpace.BytesFree,
+	})
+
 	freeSpaceErr := doFreeSpace(client, freeSpace, freeFiles)
 	if freeSpaceErr != nil {
 		logrus.Infoln("Failed to free disk space:", freeSpaceErr)
 	}
 
-	currentDiskSpace, err := client.DiskSpace(opts.MonitorPath)
+	currentDiskSpace, err := client.DiskSpace(dockerContext, opts.MonitorPath)
 	if err == nil {
-		logrus.Infoln("Freed",
-			"bytes:", humanize.Bytes(currentDiskSpace.BytesFree-diskSpace.BytesFree),
-			"files:", currentDiskSpace.FilesFree-diskSpace.FilesFree)
+		lastDiskSpace = &currentDiskSpace
+		logrus.WithFields(logrus.Fields{
+			"bytes": currentDiskSpace.BytesFree - diskSpace.BytesFree,
+			"files": currentDiskSpace.FilesFree - diskSpace.FilesFree,
+		}).Infoln("Freed", humanize.Bytes(currentDiskSpace.BytesFree-diskSpace.BytesFree))
+
+		notification := Notification{
+			Event:     eventCleanupCompleted,
+			BytesFree: currentDiskSpace.BytesFree,
+		}
+		if currentDiskSpace.BytesFree > diskSpace.BytesFree {
+			notification.BytesFreed = currentDiskSpace.BytesFree - diskSpace.BytesFree
+		}
+		if currentDiskSpace.FilesFree > diskSpace.FilesFree {
+			notification.FilesFreed = currentDiskSpace.FilesFree - diskSpace.FilesFree
+		}
+		notification.Message = fmt.Sprintf("Cleanup completed, freed %s, %s free",
+			humanize.Bytes(notification.BytesFreed), humanize.Bytes(notification.BytesFree))
+
+		if freeSpaceErr == errNothingToDelete {
+			notification.Event = eventTargetNotReached
+			notification.Error = freeSpaceErr.Error()
+			notification.Message = fmt.Sprintf("Unable to reach %s of free space, %s",
+				humanize.Bytes(freeSpace), notification.Message)
+
+			if currentDiskSpace.BytesFree < lowFreeSpace {
+				pauseRunner(currentDiskSpace)
+			}
+		}
+		notifier.Notify(notification)
 	}
 
+	if freeSpaceErr == errBudgetExhausted {
+		return nil
+	}
 	return freeSpaceErr
 }
 
+// newDockerClient connects over TLS when the certificates are configured, the daemon
+// certificate is only verified against the ca.pem when TLS verification is enabled
+func newDockerClient(credentials docker_helpers.DockerCredentials) (*docker.Client, error) {
+	endpoint := credentials.Host
+	if endpoint == "" {
+		endpoint = dockerClientEndpoint
+	}
+	if credentials.CertPath == "" {
+		return docker.NewClient(endpoint)
+	}
+
+	// without a CA the client doesn't verify the daemon certificate
+	ca := ""
+	if credentials.TLSVerify {
+		ca = filepath.Join(credentials.CertPath, "ca.pem")
+	}
+	return docker.NewTLSClient(endpoint,
+		filepath.Join(credentials.CertPath, "cert.pem"),
+		filepath.Join(credentials.CertPath, "key.pem"),
+		ca)
+}
+
 func runCleanupTool(c *cli.Context) {
 	lowFreeSpace, err := humanize.ParseBytes(opts.LowFreeSpace)
 	if err != nil {
@@ -522,32 +1041,164 @@ func runCleanupTool(c *cli.Context) {
 		logrus.Fatalln(err)
 	}
 
+	var freeSpacePerJob uint64
+	if opts.FreeSpacePerJob != "" {
+		freeSpacePerJob, err = humanize.ParseBytes(opts.FreeSpacePerJob)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+	}
+
+	protectedCacheProjects, err = parseProjectIDs(opts.ProtectedCacheProjects)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	cacheQuotas, err = parseCacheQuotas(opts.CacheQuotas)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	tagRetentions, err = parseTagRetentions(opts.TagRetention)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	deepCleanSchedule, err = parseCronSchedule(opts.DeepCleanSchedule)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	if opts.DeepCleanFreeSpace != "" {
+		deepCleanFreeSpace, err = humanize.ParseBytes(opts.DeepCleanFreeSpace)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+	}
+
+	if opts.MaxBytesPerCycle != "" {
+		maxBytesPerCycle, err = humanize.ParseBytes(opts.MaxBytesPerCycle)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+	}
+
+	quietHours, err = parseCronSchedule(opts.QuietHours)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	if opts.CriticalFreeSpace != "" {
+		criticalFreeSpace, err = humanize.ParseBytes(opts.CriticalFreeSpace)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+	}
+
+	reloadRunnerConfig(opts.RunnerConfigFile)
+	if dockerConfig := runnerConfig.dockerConfig(); dockerConfig != nil && dockerCredentials.Host == "" {
+		dockerCredentials.Host = dockerConfig.Host
+		dockerCredentials.CertPath = dockerConfig.TLSCertPath
+		dockerCredentials.TLSVerify = dockerConfig.TLSVerify
+	}
+
+	if opts.AuditLogPath != "" {
+		auditLogMaxSize, err := humanize.ParseBytes(opts.AuditLogMaxSize)
+		if err != nil {
+			logrus.Fatalln(err)
+		}
+
+		auditLog, err = openAuditLog(opts.AuditLogPath, int64(auditLogMaxSize), opts.AuditLogMaxBackups)
+		if err != nil {
+			logrus.Fatalln("Failed to open audit log:", err)
+		}
+		defer auditLog.Close()
+	}
+
+	if opts.WebhookURL != "" {
+		notifier, err = newNotifier(opts.WebhookURL, opts.WebhookFormat, opts.WebhookTemplate,
+			opts.WebhookEvents, opts.WebhookRateLimit, opts.WebhookRetries)
+		if err != nil {
+			logrus.Fatalln("Failed to configure webhook:", err)
+		}
+	}
+
+	if opts.ArchiveDir != "" {
+		imageArchive, err = openImageArchiveFromOptions()
+		if err != nil {
+			logrus.Fatalln("Failed to open the image archive:", err)
+		}
+		if sameFilesystem(opts.ArchiveDir, opts.MonitorPath) {
+			logrus.Warningln("The image archive", opts.ArchiveDir, "is on the same filesystem as", opts.MonitorPath)
+		}
+	}
+
+	if opts.MirrorRegistry != "" {
+		registryMirror = newRegistryMirror(opts.MirrorRegistry)
+	}
+
+	runnerPauser, err = newRunnerPauser(opts.PauseRunner)
+	if err != nil {
+		logrus.Fatalln("Failed to configure runner pausing:", err)
+	}
+
 	var dockerClient DockerClient
+	var unreachableSince time.Time
+	reconnect := newBackoff()
+
+	err = loadState(opts.StateFile)
+	if err != nil {
+		logrus.Warningln("Failed to load state:", err)
+	}
+	restoreRunnerPaused()
+	handleSignals()
 
 	logrus.Infoln("Watching disk space...")
-	for {
-		if dockerClient == nil || dockerClient.Ping() != nil {
+	for !isShuttingDown() {
+		if dockerClient == nil || dockerClient.Ping(dockerContext) != nil {
 			dockerClient = nil
 
-			client, err := docker.NewClient(dockerClientEndpoint)
+			var customClient *CustomDockerClient
+			client, err := newDockerClient(dockerCredentials)
+			if err == nil {
+				customClient = &CustomDockerClient{
+					Client: client,
+				}
+				err = customClient.Ping(dockerContext)
+			}
 			if err != nil {
-				logrus.Warningln("Failed to connect to daemon:", err)
-				time.Sleep(opts.RetryInterval)
+				delay := reconnect.next()
+				logrus.Warningln("Failed to connect to daemon:", err, "retrying in", delay)
+				if unreachableSince.IsZero() {
+					unreachableSince = time.Now()
+				} else if time.Since(unreachableSince) >= opts.DaemonUnreachableTimeout {
+					notifier.Notify(Notification{
+						Event:   eventDaemonUnreachable,
+						Message: fmt.Sprintf("Docker daemon unreachable for %v", time.Since(unreachableSince)),
+						Error:   err.Error(),
+					})
+				}
+				sleep(delay)
 				continue
 			}
 
-			dockerClient = &CustomDockerClient{
-				Client: client,
-			}
+			dockerClient = customClient
+			unreachableSince = time.Time{}
 		}
 
-		err = doCycle(dockerClient, lowFreeSpace, expectedFreeSpace, opts.LowFreeFilesCount, opts.ExpectedFreeFilesCount)
-		if err == nil {
-			time.Sleep(opts.CheckInterval)
-		} else {
-			time.Sleep(opts.RetryInterval)
+		reloadRunnerConfig(opts.RunnerConfigFile)
+
+		err = doCycle(dockerClient, lowFreeSpace, runnerConfig.expectedFreeSpace(expectedFreeSpace, freeSpacePerJob),
+			opts.LowFreeFilesCount, opts.ExpectedFreeFilesCount)
+		writeStatus(opts.StatusFile)
+		saveState(opts.StateFile)
+		if isTransient(err) {
+			dockerClient = nil
 		}
+		sleep(checkDelay(reconnect, err))
 	}
+	saveState(opts.StateFile)
+	logrus.Infoln("Stopped watching disk space")
 }
 
 func main() {
@@ -557,10 +1208,35 @@ func main() {
 	app.Version = fmt.Sprintf("%s (%s)", version, revision)
 	app.Author = "Kamil Trzciński"
 	app.Email = "ayufan@ayufan.eu"
-	//cli_helpers.SetupLogLevelOptions(app)
 	app.Flags = append(app.Flags, clihelpers.GetFlagsFromStruct(&dockerCredentials, "docker")...)
 	app.Flags = append(app.Flags, clihelpers.GetFlagsFromStruct(&opts)...)
+	app.Before = setupLogging
 	app.Action = runCleanupTool
+	app.Commands = []cli.Command{
+		{
+			Name:   "status",
+			Usage:  "show the images and caches from the status file",
+			Action: runStatus,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the raw status",
+				},
+			},
+		},
+		{
+			Name:      "restore",
+			Usage:     "load archived images, lists the archive without arguments",
+			ArgsUsage: "[image...]",
+			Action:    runRestore,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "pull",
+					Usage: "pull the images and only restore the ones that fail to pull",
+				},
+			},
+		},
+	}
 	if err := app.Run(os.Args); err != nil {
 		logrus.Fatal(err)
 	}
@@ -1,34 +1,54 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
 	"fmt"
 	"github.com/dustin/go-humanize"
 	. "github.com/fsouza/go-dockerclient"
 	"github.com/sirupsen/logrus"
 	. "gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 type MockDockerClient struct {
+	lock              sync.Mutex
 	error             error
 	removedImages     []string
 	removedContainers []string
+	removedVolumes    []string
+	exportedImages    []string
+	loadedImages      []string
+	taggedImages      []string
+	pushedImages      []string
 	containers        []APIContainers
 	images            []APIImages
+	volumes           []Volume
 	volumesFrom       []string
 	links             []string
+	mounts            []Mount
+	inspections       int
 	freeSpace         uint64
 	totalSpace        uint64
 	freeFiles         uint64
 	totalFiles        uint64
 }
 
-func (c *MockDockerClient) Ping() error {
+func (c *MockDockerClient) Ping(ctx context.Context) error {
 	return c.error
 }
 
-func (c *MockDockerClient) RemoveImage(name string) error {
+func (c *MockDockerClient) RemoveImage(ctx context.Context, name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if c.error != nil {
 		return c.error
 	}
@@ -42,7 +62,10 @@ func (c *MockDockerClient) RemoveImage(name string) error {
 	return nil
 }
 
-func (c *MockDockerClient) RemoveImageExtended(name string, opts RemoveImageOptions) error {
+func (c *MockDockerClient) RemoveImageExtended(ctx context.Context, name string, opts RemoveImageOptions) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if c.error != nil {
 		return c.error
 	}
@@ -56,7 +79,10 @@ func (c *MockDockerClient) RemoveImageExtended(name string, opts RemoveImageOpti
 	return nil
 }
 
-func (c *MockDockerClient) RemoveContainer(opts RemoveContainerOptions) error {
+func (c *MockDockerClient) RemoveContainer(ctx context.Context, opts RemoveContainerOptions) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if c.error != nil {
 		return c.error
 	}
@@ -70,15 +96,79 @@ func (c *MockDockerClient) RemoveContainer(opts RemoveContainerOptions) error {
 	return nil
 }
 
-func (c *MockDockerClient) ListImages(opts ListImagesOptions) ([]APIImages, error) {
+func (c *MockDockerClient) ListVolumes(ctx context.Context, opts ListVolumesOptions) ([]Volume, error) {
+	return c.volumes, c.error
+}
+
+func (c *MockDockerClient) RemoveVolume(ctx context.Context, name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.error != nil {
+		return c.error
+	}
+	c.removedVolumes = append(c.removedVolumes, name)
+	return nil
+}
+
+func (c *MockDockerClient) ExportImages(ctx context.Context, opts ExportImagesOptions) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.error != nil {
+		return c.error
+	}
+	c.exportedImages = append(c.exportedImages, opts.Names...)
+	_, err := io.WriteString(opts.OutputStream, strings.Join(opts.Names, "\n"))
+	return err
+}
+
+func (c *MockDockerClient) LoadImage(ctx context.Context, opts LoadImageOptions) error {
+	if c.error != nil {
+		return c.error
+	}
+	data, err := ioutil.ReadAll(opts.InputStream)
+	if err != nil {
+		return err
+	}
+	c.loadedImages = append(c.loadedImages, strings.Split(string(data), "\n")...)
+	return nil
+}
+
+func (c *MockDockerClient) TagImage(ctx context.Context, name string, opts TagImageOptions) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.error != nil {
+		return c.error
+	}
+	c.taggedImages = append(c.taggedImages, opts.Repo+":"+opts.Tag)
+	return nil
+}
+
+func (c *MockDockerClient) PushImage(ctx context.Context, opts PushImageOptions, auth AuthConfiguration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.error != nil {
+		return c.error
+	}
+	c.pushedImages = append(c.pushedImages, opts.Name+":"+opts.Tag)
+	return nil
+}
+
+func (c *MockDockerClient) ListImages(ctx context.Context, opts ListImagesOptions) ([]APIImages, error) {
 	return c.images, c.error
 }
 
-func (c *MockDockerClient) ListContainers(opts ListContainersOptions) ([]APIContainers, error) {
+func (c *MockDockerClient) ListContainers(ctx context.Context, opts ListContainersOptions) ([]APIContainers, error) {
 	return c.containers, c.error
 }
 
-func (c *MockDockerClient) DiskSpace(path string) (DiskSpace, error) {
+func (c *MockDockerClient) DiskSpace(ctx context.Context, path string) (DiskSpace, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	return DiskSpace{
 		BytesFree:  c.freeSpace,
 		BytesTotal: c.totalSpace,
@@ -87,20 +177,29 @@ func (c *MockDockerClient) DiskSpace(path string) (DiskSpace, error) {
 	}, c.error
 }
 
-func (c *MockDockerClient) InspectContainer(id string) (*Container, error) {
+func (c *MockDockerClient) InspectContainer(ctx context.Context, id string) (*Container, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.inspections++
 	for idx, container := range c.containers {
 		if container.ID == id {
+			name := id
+			if len(container.Names) > 0 {
+				name = container.Names[0]
+			}
 			data := &Container{
 				ID:              id,
-				Name:            id,
+				Name:            name,
 				Image:           container.Image,
 				HostConfig:      &HostConfig{},
-				Config:          &Config{},
+				Config:          &Config{Image: container.Image, Labels: container.Labels},
 				NetworkSettings: &NetworkSettings{},
 			}
 			if idx == 0 {
 				data.HostConfig.VolumesFrom = c.volumesFrom
 				data.HostConfig.Links = c.links
+				data.Mounts = c.mounts
 			}
 			return data, nil
 		}
@@ -120,12 +219,61 @@ var _ = Suite(&CleanupSuite{})
 
 func (s *CleanupSuite) SetUpTest(c *C) {
 	opts.DefaultTTL = 0 * time.Nanosecond
+	opts.LogLevel = "debug"
+	opts.LogFormat = "text"
 	s.dockerClient = &MockDockerClient{}
 	imagesUsed = make(map[string]ImageInfo)
 	cachesUsed = make(map[string]CacheInfo)
+	imageHistories = make(map[string]*ImageUsageHistory)
+	inspectedContainers = make(map[string]*Container)
+	containerIDs = make(map[string]string)
+	removalFailures = make(map[string]*RemovalFailure)
+	restoreAttempts = make(map[string]time.Time)
 	logrus.SetLevel(logrus.DebugLevel)
 }
 
+func (s *CleanupSuite) TearDownTest(c *C) {
+	auditLog.Close()
+	auditLog = nil
+	runnerPauser = nil
+	runnerPaused = false
+	runnerConfig = nil
+	detectedRunnerVersion = ""
+	retainedHelperImages = nil
+	protectedCacheProjects = nil
+	cacheQuotas = nil
+	lastDiskSpace = nil
+	imageRemovals = 0
+	imageThrashes = 0
+	imageArchive = nil
+	internalImages = nil
+	opts.ArchiveAutoRestore = false
+	registryMirror = nil
+	tagRetentions = nil
+	opts.MaxImageAge = 0
+	opts.MaxCacheAge = 0
+	deepCleanSchedule = nil
+	deepCleanFreeSpace = 0
+	quietHours = nil
+	criticalFreeSpace = 0
+	lastScheduleCheck = time.Time{}
+	deepCleanPending = false
+	runningBuilds = 0
+	deferredSince = time.Time{}
+	opts.WaitForIdle = false
+	cycleBudget = nil
+	maxBytesPerCycle = 0
+	opts.MaxRemovalsPerCycle = 0
+	opts.MaxCycleTime = 0
+	opts.RemovalDelay = 0
+	opts.InspectWorkers = 1
+	opts.RemovalWorkers = 1
+	opts.DockerTimeout = time.Minute
+	opts.CacheMeasureInterval = 10 * time.Minute
+	shutdownRequested = make(chan struct{})
+	shutdownOnce = sync.Once{}
+}
+
 func makeDockerImageWithParent(name string, parent string) APIImages {
 	return APIImages{
 		ID: name,
@@ -170,8 +318,12 @@ func makeDockerContainerWithSize(name string, image string, size uint64) APICont
 	}
 }
 
+func makeDockerCacheName(project int, id string) string {
+	return fmt.Sprintf("runner-abcd1234-project-%d-concurrent-0-cache-%x", project, md5.Sum([]byte(id)))
+}
+
 func makeDockerCache(id string, size uint64) APIContainers {
-	return makeDockerContainerWithSize(fmt.Sprintf("runner-RID-project-PID-concurrent-CID-cache-%v", id), "cache", size)
+	return makeDockerContainerWithSize(makeDockerCacheName(1, id), "cache", size)
 }
 
 func (s *CleanupSuite) TestInternalImage(c *C) {
@@ -185,14 +337,34 @@ func (s *CleanupSuite) TestInternalImage(c *C) {
 	c.Assert(userImage, Equals, false)
 }
 
+func (s *CleanupSuite) TestInternalImagesAreReadOncePerCheck(c *C) {
+	path := filepath.Join(c.MkDir(), "internal-images")
+	err := ioutil.WriteFile(path, []byte("custom:*\n"), 0600)
+	c.Assert(err, IsNil)
+	defer func(previous string) { opts.AdditionalInternalImagesFilePath = previous }(opts.AdditionalInternalImagesFilePath)
+	opts.AdditionalInternalImagesFilePath = path
+
+	err = doCycle(s.dockerClient, 0, 0, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(isInternalImage(makeDockerImage("custom:1")), Equals, true)
+
+	err = os.Remove(path)
+	c.Assert(err, IsNil)
+	c.Assert(isInternalImage(makeDockerImage("custom:1")), Equals, true)
+
+	err = doCycle(s.dockerClient, 0, 0, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(isInternalImage(makeDockerImage("custom:1")), Equals, false)
+}
+
 func (s *CleanupSuite) TestRemoveImage(c *C) {
-	err := removeImage(s.dockerClient, makeDockerImage("test"))
+	_, err := removeImage(s.dockerClient, makeDockerImage("test"))
 	c.Assert(err, IsNil)
 	c.Assert(s.dockerClient.removedImages, HasLen, 1)
 	c.Assert(s.dockerClient.removedImages[0], Equals, "test")
 
 	s.dockerClient.error = ErrConnectionRefused
-	err = removeImage(s.dockerClient, makeDockerImage("error"))
+	_, err = removeImage(s.dockerClient, makeDockerImage("error"))
 	c.Assert(err, Equals, ErrConnectionRefused)
 }
 
@@ -201,9 +373,12 @@ func (s *CleanupSuite) TestCacheContainerDetection(c *C) {
 	c.Assert(result, Equals, false)
 
 	result = isCacheContainer("runner-RID-project-PID-concurrent-CID-cache-ID")
+	c.Assert(result, Equals, false)
+
+	result = isCacheContainer("runner-abcd1234-project-1-concurrent-0-cache-3c3f060a0374fc8bc39395164f415a70")
 	c.Assert(result, Equals, true)
 
-	result = isCacheContainer("runner", "runner-RID-project-PID-concurrent-CID-cache-ID")
+	result = isCacheContainer("runner", "/runner-abcd1234-project-1-concurrent-0-cache-3c3f060a0374fc8bc39395164f415a70")
 	c.Assert(result, Equals, true)
 }
 
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"strings"
+)
+
+// inspectedContainers caches the inspected containers by their ID,
+// the image and the host config of a container never change after it's created
+var inspectedContainers = make(map[string]*docker.Container)
+
+// containerIDs maps the names of the listed containers to their IDs,
+// a container recreated with the same name gets a new ID
+var containerIDs = make(map[string]string)
+
+// updateInspectedContainers forgets the containers that are gone
+// and maps the names used by VolumesFrom and Links to the current IDs
+func updateInspectedContainers(containers []docker.APIContainers) {
+	containerIDs = make(map[string]string)
+	for _, container := range containers {
+		containerIDs[container.ID] = container.ID
+		for _, name := range container.Names {
+			containerIDs[strings.TrimPrefix(name, "/")] = container.ID
+		}
+	}
+
+	for id := range inspectedContainers {
+		if _, ok := containerIDs[id]; !ok {
+			delete(inspectedContainers, id)
+		}
+	}
+}
+
+// resolveContainerID returns the ID of the listed container with the name,
+// the unknown names are returned as they are
+func resolveContainerID(name string) string {
+	if id, ok := containerIDs[strings.TrimPrefix(name, "/")]; ok {
+		return id
+	}
+	return name
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (s *CleanupSuite) TestInspectedContainersAreCached(c *C) {
+	s.dockerClient.images = []APIImages{
+		makeDockerImage("image1"),
+		makeDockerImage("image2"),
+	}
+	s.dockerClient.containers = []APIContainers{
+		makeDockerContainer("container1", "image1"),
+		makeDockerContainer("container2", "image2"),
+	}
+	s.dockerClient.links = []string{"container2:alias"}
+
+	updateImages(s.dockerClient)
+	err := updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.inspections, Equals, 2)
+
+	imagesUsed = make(map[string]ImageInfo)
+	updateImages(s.dockerClient)
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.inspections, Equals, 2)
+	c.Assert(imagesUsed["image1"].Used.IsZero(), Equals, false)
+	c.Assert(imagesUsed["image2"].Used.IsZero(), Equals, false)
+}
+
+func (s *CleanupSuite) TestInspectedContainersArePruned(c *C) {
+	s.dockerClient.containers = []APIContainers{
+		makeDockerContainer("container1", "image1"),
+		makeDockerContainer("container2", "image2"),
+	}
+	err := updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(inspectedContainers, HasLen, 2)
+
+	s.dockerClient.containers = s.dockerClient.containers[:1]
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(inspectedContainers, HasLen, 1)
+	c.Assert(inspectedContainers["container1"], NotNil)
+	c.Assert(s.dockerClient.inspections, Equals, 2)
+}
+
+func (s *CleanupSuite) TestRecreatedLinkedContainer(c *C) {
+	opts.DefaultTTL = time.Hour
+	cacheName := makeDockerCacheName(1, "cache")
+	s.dockerClient.containers = []APIContainers{
+		makeDockerContainer("build", "image"),
+		{ID: "old", Image: "cache", Names: []string{"/" + cacheName}},
+	}
+	s.dockerClient.volumesFrom = []string{cacheName}
+
+	err := updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(inspectedContainers["old"], NotNil)
+
+	s.dockerClient.containers[1].ID = "new"
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(inspectedContainers["old"], IsNil)
+	c.Assert(inspectedContainers[cacheName], IsNil)
+	c.Assert(inspectedContainers["new"].ID, Equals, "new")
+
+	cache := cachesUsed["new"]
+	cache.TTL = time.Now().Add(-time.Hour)
+	cachesUsed["new"] = cache
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	cache = cachesUsed["new"]
+	c.Assert(cache.score() < 0, Equals, true)
+}
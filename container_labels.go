@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const runnerLabelPrefix = "com.gitlab.gitlab-runner."
+
+const (
+	containerTypeBuild   = "build"
+	containerTypeHelper  = "predefined"
+	containerTypeService = "service"
+	containerTypeCache   = "cache"
+)
+
+var runnerContainerRegexp = regexp.MustCompile(`^/?runner-[0-9A-Za-z_-]{8,9}-project-\d+-concurrent-\d+-(?:[0-9a-f]+-)?(build|predefined)(?:-\d+)?$`)
+
+type RunnerLabels struct {
+	Type       string `json:"type,omitempty"`
+	JobID      int64  `json:"job_id,omitempty"`
+	ProjectID  int64  `json:"project_id,omitempty"`
+	PipelineID int64  `json:"pipeline_id,omitempty"`
+	RunnerID   string `json:"runner_id,omitempty"`
+}
+
+func parseLabelID(labels map[string]string, name string) int64 {
+	id, _ := strconv.ParseInt(labels[runnerLabelPrefix+name], 10, 64)
+	return id
+}
+
+func parseRunnerLabels(labels map[string]string) (RunnerLabels, bool) {
+	containerType, ok := labels[runnerLabelPrefix+"type"]
+	if !ok {
+		return RunnerLabels{}, false
+	}
+
+	return RunnerLabels{
+		Type:       containerType,
+		JobID:      parseLabelID(labels, "job.id"),
+		ProjectID:  parseLabelID(labels, "project.id"),
+		PipelineID: parseLabelID(labels, "pipeline.id"),
+		RunnerID:   labels[runnerLabelPrefix+"runner.id"],
+	}, true
+}
+
+func (l RunnerLabels) fields() logrus.Fields {
+	return logrus.Fields{
+		"type":        l.Type,
+		"job_id":      l.JobID,
+		"project_id":  l.ProjectID,
+		"pipeline_id": l.PipelineID,
+		"runner_id":   l.RunnerID,
+	}
+}
+
+// cacheNameOf uses the runner labels when present
+// and falls back to the cache name matching otherwise.
+func cacheNameOf(names []string, labels map[string]string) (CacheName, bool) {
+	runnerLabels, ok := parseRunnerLabels(labels)
+	if !ok {
+		return findCacheName(names...)
+	}
+	if runnerLabels.Type != containerTypeCache {
+		return CacheName{}, false
+	}
+
+	for _, name := range names {
+		if !runnerConfig.ownsCache(name) {
+			return CacheName{}, false
+		}
+	}
+	cacheName, _ := parseCacheNames(names...)
+	if runnerLabels.ProjectID != 0 {
+		cacheName.ProjectID = runnerLabels.ProjectID
+	}
+	return cacheName, true
+}
+
+func containerType(names []string, labels map[string]string) string {
+	if runnerLabels, ok := parseRunnerLabels(labels); ok {
+		return runnerLabels.Type
+	}
+	if isCacheContainer(names...) {
+		return containerTypeCache
+	}
+	for _, name := range names {
+		if match := runnerContainerRegexp.FindStringSubmatch(name); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+func attributeImageUsage(id, containerID string, labels map[string]string) {
+	image, ok := imagesUsed[id]
+	if !ok {
+		return
+	}
+
+	runnerLabels, ok := parseRunnerLabels(labels)
+	recordImageUse(image.APIImages, containerID, runnerLabels, time.Now())
+	if !ok || runnerLabels.JobID == 0 {
+		return
+	}
+
+	image.LastJob = runnerLabels
+	imagesUsed[id] = image
+	logrus.WithFields(runnerLabels.fields()).Debugln("Image", id, "used by job")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+)
+
+func makeRunnerLabels(containerType string, projectID string) map[string]string {
+	return map[string]string{
+		"com.gitlab.gitlab-runner.type":        containerType,
+		"com.gitlab.gitlab-runner.job.id":      "100",
+		"com.gitlab.gitlab-runner.project.id":  projectID,
+		"com.gitlab.gitlab-runner.pipeline.id": "10",
+		"com.gitlab.gitlab-runner.runner.id":   "abcd1234",
+		"com.gitlab.gitlab-runner.managed":     "true",
+	}
+}
+
+func (s *CleanupSuite) TestParseRunnerLabels(c *C) {
+	labels, ok := parseRunnerLabels(makeRunnerLabels(containerTypeBuild, "42"))
+	c.Assert(ok, Equals, true)
+	c.Assert(labels, DeepEquals, RunnerLabels{
+		Type:       containerTypeBuild,
+		JobID:      100,
+		ProjectID:  42,
+		PipelineID: 10,
+		RunnerID:   "abcd1234",
+	})
+
+	_, ok = parseRunnerLabels(map[string]string{"maintainer": "me"})
+	c.Assert(ok, Equals, false)
+}
+
+func (s *CleanupSuite) TestContainerType(c *C) {
+	c.Assert(containerType([]string{"/test"}, makeRunnerLabels(containerTypeService, "1")), Equals, containerTypeService)
+	c.Assert(containerType([]string{"/runner-abcd1234-project-1-concurrent-0-build"}, nil), Equals, containerTypeBuild)
+	c.Assert(containerType([]string{"/runner-abcd1234-project-1-concurrent-0-0123abcd-predefined"}, nil), Equals, containerTypeHelper)
+	c.Assert(containerType([]string{"/" + makeDockerCacheName(1, "cache")}, nil), Equals, containerTypeCache)
+	c.Assert(containerType([]string{"/test"}, nil), Equals, "")
+}
+
+func (s *CleanupSuite) TestLabeledCacheContainers(c *C) {
+	labeledCache := makeDockerContainer("custom-cache-name", "cache")
+	labeledCache.Labels = makeRunnerLabels(containerTypeCache, "42")
+
+	labeledBuild := makeDockerContainer(makeDockerCacheName(1, "build"), "image")
+	labeledBuild.Labels = makeRunnerLabels(containerTypeBuild, "1")
+
+	s.dockerClient.containers = []APIContainers{
+		labeledCache,
+		labeledBuild,
+	}
+
+	err := updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(cachesUsed, HasLen, 1)
+	c.Assert(cachesUsed[labeledCache.ID].Name.ProjectID, Equals, int64(42))
+}
+
+func (s *CleanupSuite) TestImageUsageAttribution(c *C) {
+	build := makeDockerContainer("build", "test")
+	build.Labels = makeRunnerLabels(containerTypeBuild, "42")
+	s.dockerClient.containers = []APIContainers{build}
+	s.dockerClient.images = []APIImages{makeDockerImage("test")}
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	handleDockerContainerID(s.dockerClient, "build")
+	c.Assert(imagesUsed["test"].LastJob.ProjectID, Equals, int64(42))
+	c.Assert(imagesUsed["test"].LastJob.JobID, Equals, int64(100))
+
+	err = updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imagesUsed["test"].LastJob.JobID, Equals, int64(100))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"time"
+)
+
+// dockerContext is cancelled on shutdown to abort the Docker calls in flight
+var dockerContext = context.Background()
+
+// TimeoutError is returned when the Docker daemon doesn't answer within the timeout
+type TimeoutError struct {
+	Call    string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("docker %s timed out after %v", e.Call, e.Timeout)
+}
+
+func isTimeout(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
+// withTimeout runs the call with a deadline and reports the deadline being exceeded as a TimeoutError
+func withTimeout(ctx context.Context, call string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := fn(ctx)
+	if err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return &TimeoutError{Call: call, Timeout: timeout}
+		case context.Canceled:
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (c *CustomDockerClient) Ping(ctx context.Context) error {
+	return withTimeout(ctx, "Ping", opts.DockerTimeout, func(ctx context.Context) error {
+		return c.Client.PingWithContext(ctx)
+	})
+}
+
+func (c *CustomDockerClient) ListImages(ctx context.Context, options docker.ListImagesOptions) (images []docker.APIImages, err error) {
+	err = withTimeout(ctx, "ListImages", opts.DockerTimeout, func(ctx context.Context) (err error) {
+		options.Context = ctx
+		images, err = c.Client.ListImages(options)
+		return
+	})
+	return
+}
+
+func (c *CustomDockerClient) ListContainers(ctx context.Context, options docker.ListContainersOptions) (containers []docker.APIContainers, err error) {
+	err = withTimeout(ctx, "ListContainers", opts.DockerTimeout, func(ctx context.Context) (err error) {
+		options.Context = ctx
+		containers, err = c.Client.ListContainers(options)
+		return
+	})
+	return
+}
+
+func (c *CustomDockerClient) RemoveImageExtended(ctx context.Context, name string, options docker.RemoveImageOptions) error {
+	return withTimeout(ctx, "RemoveImage", opts.DockerTimeout, func(ctx context.Context) error {
+		options.Context = ctx
+		return c.Client.RemoveImageExtended(name, options)
+	})
+}
+
+func (c *CustomDockerClient) RemoveContainer(ctx context.Context, options docker.RemoveContainerOptions) error {
+	return withTimeout(ctx, "RemoveContainer", opts.DockerTimeout, func(ctx context.Context) error {
+		options.Context = ctx
+		return c.Client.RemoveContainer(options)
+	})
+}
+
+func (c *CustomDockerClient) ListVolumes(ctx context.Context, options docker.ListVolumesOptions) (volumes []docker.Volume, err error) {
+	err = withTimeout(ctx, "ListVolumes", opts.DockerTimeout, func(ctx context.Context) (err error) {
+		options.Context = ctx
+		volumes, err = c.Client.ListVolumes(options)
+		return
+	})
+	return
+}
+
+func (c *CustomDockerClient) RemoveVolume(ctx context.Context, name string) error {
+	return withTimeout(ctx, "RemoveVolume", opts.DockerTimeout, func(ctx context.Context) error {
+		return c.Client.RemoveVolumeWithOptions(docker.RemoveVolumeOptions{
+			Context: ctx,
+			Name:    name,
+		})
+	})
+}
+
+func (c *CustomDockerClient) ExportImages(ctx context.Context, options docker.ExportImagesOptions) error {
+	return withTimeout(ctx, "ExportImages", opts.DockerTransferTimeout, func(ctx context.Context) error {
+		options.Context = ctx
+		return c.Client.ExportImages(options)
+	})
+}
+
+func (c *CustomDockerClient) TagImage(ctx context.Context, name string, options docker.TagImageOptions) error {
+	return withTimeout(ctx, "TagImage", opts.DockerTimeout, func(ctx context.Context) error {
+		options.Context = ctx
+		return c.Client.TagImage(name, options)
+	})
+}
+
+func (c *CustomDockerClient) PushImage(ctx context.Context, options docker.PushImageOptions, auth docker.AuthConfiguration) error {
+	return withTimeout(ctx, "PushImage", opts.DockerTransferTimeout, func(ctx context.Context) error {
+		options.Context = ctx
+		return c.Client.PushImage(options, auth)
+	})
+}
+
+func (c *CustomDockerClient) PullImage(ctx context.Context, options docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	return withTimeout(ctx, "PullImage", opts.DockerTransferTimeout, func(ctx context.Context) error {
+		options.Context = ctx
+		return c.Client.PullImage(options, auth)
+	})
+}
+
+func (c *CustomDockerClient) LoadImage(ctx context.Context, options docker.LoadImageOptions) error {
+	return withTimeout(ctx, "LoadImage", opts.DockerTransferTimeout, func(ctx context.Context) error {
+		options.Context = ctx
+		return c.Client.LoadImage(options)
+	})
+}
+
+func (c *CustomDockerClient) InspectContainer(ctx context.Context, id string) (container *docker.Container, err error) {
+	err = withTimeout(ctx, "InspectContainer", opts.DockerTimeout, func(ctx context.Context) (err error) {
+		container, err = c.Client.InspectContainerWithOptions(docker.InspectContainerOptions{
+			Context: ctx,
+			ID:      id,
+		})
+		return
+	})
+	return
+}
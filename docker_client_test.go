@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	. "github.com/fsouza/go-dockerclient"
+	"gitlab.com/gitlab-org/gitlab-runner/helpers/docker"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+)
+
+func (s *CleanupSuite) TestWithTimeout(c *C) {
+	err := withTimeout(context.Background(), "Test", 10*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	c.Assert(isTimeout(err), Equals, true)
+	c.Assert(err, ErrorMatches, "docker Test timed out after 10ms")
+
+	failure := errors.New("failure")
+	err = withTimeout(context.Background(), "Test", time.Minute, func(ctx context.Context) error {
+		return failure
+	})
+	c.Assert(err, Equals, failure)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = withTimeout(ctx, "Test", time.Minute, func(ctx context.Context) error {
+		return ctx.Err()
+	})
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(isTimeout(err), Equals, false)
+}
+
+func (s *CleanupSuite) TestDockerCallTimeout(c *C) {
+	opts.DockerTimeout = 50 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL)
+	c.Assert(err, IsNil)
+	dockerClient := &CustomDockerClient{
+		Client: client,
+	}
+
+	_, err = dockerClient.ListImages(context.Background(), ListImagesOptions{})
+	c.Assert(isTimeout(err), Equals, true)
+
+	_, err = dockerClient.InspectContainer(context.Background(), "container")
+	c.Assert(err, ErrorMatches, "docker InspectContainer timed out after 50ms")
+}
+
+func (s *CleanupSuite) TestDockerClientVerifiesTLSOnlyWhenEnabled(c *C) {
+	certPath := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(certPath, "ca.pem"), []byte("invalid"), 0600)
+	c.Assert(err, IsNil)
+	credentials := docker_helpers.DockerCredentials{
+		Host:     "tcp://127.0.0.1:2376",
+		CertPath: certPath,
+	}
+
+	client, err := newDockerClient(credentials)
+	c.Assert(err, IsNil)
+	c.Assert(client.TLSConfig.InsecureSkipVerify, Equals, true)
+
+	credentials.TLSVerify = true
+	_, err = newDockerClient(credentials)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// expiredImages returns the unprotected images unused for longer than the max age,
+// only the leaf images are returned, their parents expire on the next check
+func expiredImages(now time.Time) (images []ImageInfo) {
+	if opts.MaxImageAge <= 0 {
+		return
+	}
+
+	var all []docker.APIImages
+	for _, image := range imagesUsed {
+		all = append(all, image.APIImages)
+	}
+	tree := newImageTree(all)
+
+	for _, image := range imagesUsed {
+		if now.Sub(image.Used) <= opts.MaxImageAge || !tree.isLeaf(image.ID) || removalBlocked(image.ID) {
+			continue
+		}
+		if isInternalImage(image.APIImages) {
+			if _, stale := image.retainedTags(); len(stale) == 0 {
+				continue
+			}
+		}
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Used.Before(images[j].Used)
+	})
+	return
+}
+
+func expiredCaches(now time.Time) (caches []CacheInfo) {
+	if opts.MaxCacheAge <= 0 {
+		return
+	}
+
+	for _, cache := range cachesUsed {
+		if now.Sub(cache.Used) > opts.MaxCacheAge && !isProtectedCache(cache.Name) && !removalBlocked(cache.ID) {
+			caches = append(caches, cache)
+		}
+	}
+	sort.Slice(caches, func(i, j int) bool {
+		return caches[i].Used.Before(caches[j].Used)
+	})
+	return
+}
+
+func enforceMaxAge(client DockerClient) error {
+	now := time.Now()
+	images := expiredImages(now)
+	caches := expiredCaches(now)
+	if len(images) == 0 && len(caches) == 0 {
+		return nil
+	}
+
+	diskSpace, err := client.DiskSpace(dockerContext, opts.MonitorPath)
+	if err != nil {
+		return err
+	}
+
+	var lastError error
+	for _, image := range images {
+		if !cycleBudget.allow() {
+			return lastError
+		}
+		logrus.WithFields(imageFields(image.APIImages)).Infoln("Image unused for", now.Sub(image.Used))
+		_, stale := image.retainedTags()
+		untagged, removeErr := removeImage(client, image.APIImages)
+		if untagged {
+			cycleBudget.spend(0)
+		} else {
+			cycleBudget.spend(image.Size)
+		}
+
+		before := diskSpace
+		diskSpace, err = client.DiskSpace(dockerContext, opts.MonitorPath)
+		if err != nil {
+			return err
+		}
+		if untagged {
+			auditImageUntag(image, stale, "max-age", &before, &diskSpace, removeErr)
+		} else {
+			auditImageRemoval(image, "max-age", &before, &diskSpace, removeErr)
+		}
+		if removeErr != nil {
+			lastError = removeErr
+		} else if !untagged {
+			delete(imagesUsed, image.ID)
+		}
+	}
+
+	for _, cache := range caches {
+		if !cycleBudget.allow() {
+			return lastError
+		}
+		logrus.WithFields(cacheFields(cache)).Infoln("Cache unused for", now.Sub(cache.Used))
+		removeErr := removeCache(client, cache)
+		cycleBudget.spend(cache.size())
+
+		before := diskSpace
+		diskSpace, err = client.DiskSpace(dockerContext, opts.MonitorPath)
+		if err != nil {
+			return err
+		}
+		auditCacheRemoval(cache, "max-age", &before, &diskSpace, removeErr)
+		if removeErr != nil {
+			lastError = removeErr
+		} else {
+			delete(cachesUsed, cache.ID)
+		}
+	}
+	return lastError
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (s *CleanupSuite) TestExpiredImagesAreRemoved(c *C) {
+	opts.MaxImageAge = time.Hour
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithParent("old", ""),
+		makeDockerImageWithParent("old-child", "old"),
+		makeDockerImage("recent"),
+		makeDockerImage("gitlab/gitlab-runner:latest"),
+	}
+	s.dockerClient.freeSpace = 100000
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	for _, id := range []string{"old", "old-child", "gitlab/gitlab-runner:latest"} {
+		image := imagesUsed[id]
+		image.Used = time.Now().Add(-2 * time.Hour)
+		imagesUsed[id] = image
+	}
+
+	err = doCycle(s.dockerClient, 0, 0, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"old-child"})
+}
+
+func (s *CleanupSuite) TestExpiredImageKeptForItsTagsIsNotForgotten(c *C) {
+	opts.MaxImageAge = time.Hour
+	s.dockerClient.images = []APIImages{makeDockerMultiTagImage("image", "ruby:2.3", "ruby:latest")}
+	s.dockerClient.freeSpace = 100000
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	image := imagesUsed["image"]
+	image.Used = time.Now().Add(-2 * time.Hour)
+	image.Tags["ruby:latest"] = ObjectTTL{TTL: time.Now().Add(time.Hour)}
+	imagesUsed["image"] = image
+
+	err = enforceMaxAge(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"ruby:2.3"})
+	c.Assert(imagesUsed["image"].Tags["ruby:latest"].TTL.After(time.Now()), Equals, true)
+}
+
+func (s *CleanupSuite) TestExpiredCachesAreRemoved(c *C) {
+	opts.MaxCacheAge = time.Hour
+	protectedCacheProjects = map[int64]bool{2: true}
+	cachesUsed["old"] = CacheInfo{
+		APIContainers: APIContainers{ID: "old"},
+		ObjectTTL:     ObjectTTL{Used: time.Now().Add(-2 * time.Hour)},
+		Name:          CacheName{ProjectID: 1},
+	}
+	cachesUsed["protected"] = CacheInfo{
+		APIContainers: APIContainers{ID: "protected"},
+		ObjectTTL:     ObjectTTL{Used: time.Now().Add(-2 * time.Hour)},
+		Name:          CacheName{ProjectID: 2},
+	}
+	cachesUsed["recent"] = CacheInfo{
+		APIContainers: APIContainers{ID: "recent"},
+		ObjectTTL:     ObjectTTL{Used: time.Now()},
+		Name:          CacheName{ProjectID: 1},
+	}
+
+	err := enforceMaxAge(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedContainers, DeepEquals, []string{"old"})
+	c.Assert(cachesUsed, HasLen, 2)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var runnerImages = []string{
+	"gitlab/gitlab-runner:*",
+	"registry.gitlab.com/gitlab-org/gitlab-runner:*",
+}
+
+var helperImages = []string{
+	"gitlab/gitlab-runner-helper:*",
+	"registry.gitlab.com/gitlab-org/gitlab-runner/gitlab-runner-helper:*",
+}
+
+var runnerVersionRegexp = regexp.MustCompile(`(?:^|-)v?(\d+\.\d+\.\d+)(?:-|$)`)
+var helperVersionRegexp = regexp.MustCompile(`(?:^|-)(v\d+\.\d+\.\d+|[0-9a-f]{8})(?:-|$)`)
+
+var detectedRunnerVersion string
+
+// retainedHelperImages holds the IDs of the helper images to keep.
+// When nil all helper images are kept.
+var retainedHelperImages map[string]bool
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func imageTag(name string) string {
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		return name[idx+1:]
+	}
+	return ""
+}
+
+func parseRunnerVersion(version string) string {
+	if match := runnerVersionRegexp.FindStringSubmatch(version); match != nil {
+		return match[1]
+	}
+	return version
+}
+
+func helperImageVersion(tag string) string {
+	if !matchesAny(helperImages, tag) {
+		return ""
+	}
+	match := helperVersionRegexp.FindStringSubmatch(imageTag(tag))
+	if match == nil {
+		return ""
+	}
+	return strings.TrimPrefix(match[1], "v")
+}
+
+func isHelperImage(image docker.APIImages) bool {
+	for _, tag := range image.RepoTags {
+		if matchesAny(helperImages, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func detectRunnerVersion(containers []docker.APIContainers) string {
+	if opts.RunnerVersion != "" {
+		return parseRunnerVersion(opts.RunnerVersion)
+	}
+	for _, container := range containers {
+		if container.State != "running" || !matchesAny(runnerImages, container.Image) {
+			continue
+		}
+		if match := runnerVersionRegexp.FindStringSubmatch(imageTag(container.Image)); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+type helperImageVersionGroup struct {
+	version string
+	created int64
+	images  []string
+}
+
+func retainHelperImages(images map[string]ImageInfo, version string, previousVersions int) map[string]bool {
+	if version == "" || previousVersions < 0 {
+		return nil
+	}
+
+	groups := make(map[string]*helperImageVersionGroup)
+	for _, image := range images {
+		for _, tag := range image.RepoTags {
+			tagVersion := helperImageVersion(tag)
+			if tagVersion == "" {
+				continue
+			}
+			group := groups[tagVersion]
+			if group == nil {
+				group = &helperImageVersionGroup{version: tagVersion}
+				groups[tagVersion] = group
+			}
+			if image.Created > group.created {
+				group.created = image.Created
+			}
+			group.images = append(group.images, image.ID)
+		}
+	}
+
+	var sorted []*helperImageVersionGroup
+	for _, group := range groups {
+		sorted = append(sorted, group)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].created > sorted[j].created
+	})
+
+	// keep the current version and the versions released before it,
+	// or the newest ones if the current version was not pulled yet
+	current := 0
+	for idx, group := range sorted {
+		if group.version == version {
+			current = idx
+			break
+		}
+	}
+
+	retained := make(map[string]bool)
+	for idx := current; idx < len(sorted) && idx <= current+previousVersions; idx++ {
+		for _, id := range sorted[idx].images {
+			retained[id] = true
+		}
+	}
+	return retained
+}
+
+func updateHelperImages() {
+	retainedHelperImages = retainHelperImages(imagesUsed, detectedRunnerVersion, opts.HelperImageVersions)
+	if retainedHelperImages != nil {
+		logrus.WithFields(logrus.Fields{
+			"version":  detectedRunnerVersion,
+			"retained": len(retainedHelperImages),
+		}).Debugln("Retaining helper images")
+	}
+}
+
+func isRetainedHelperImage(image docker.APIImages) bool {
+	if !isHelperImage(image) {
+		return false
+	}
+	return retainedHelperImages == nil || retainedHelperImages[image.ID]
+}
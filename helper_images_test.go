@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+)
+
+func makeDockerHelperImage(id string, created int64, tags ...string) APIImages {
+	return APIImages{
+		ID:       id,
+		RepoTags: tags,
+		Created:  created,
+	}
+}
+
+func (s *CleanupSuite) TestHelperImageVersion(c *C) {
+	c.Assert(helperImageVersion("gitlab/gitlab-runner-helper:x86_64-v16.5.0"), Equals, "16.5.0")
+	c.Assert(helperImageVersion("gitlab/gitlab-runner-helper:alpine3.18-x86_64-v16.5.0-pwsh"), Equals, "16.5.0")
+	c.Assert(helperImageVersion("registry.gitlab.com/gitlab-org/gitlab-runner/gitlab-runner-helper:x86_64-f100a208"), Equals, "f100a208")
+	c.Assert(helperImageVersion("gitlab/gitlab-runner-helper:x86_64-latest"), Equals, "")
+	c.Assert(helperImageVersion("ruby:2.1"), Equals, "")
+}
+
+func (s *CleanupSuite) TestDetectRunnerVersion(c *C) {
+	containers := []APIContainers{
+		{ID: "build", Image: "ruby:2.1", State: "running"},
+		{ID: "old", Image: "gitlab/gitlab-runner:v16.4.0", State: "exited"},
+		{ID: "runner", Image: "gitlab/gitlab-runner:alpine-v16.5.0", State: "running"},
+	}
+	c.Assert(detectRunnerVersion(containers), Equals, "16.5.0")
+
+	opts.RunnerVersion = "v16.6.1"
+	defer func() { opts.RunnerVersion = "" }()
+	c.Assert(detectRunnerVersion(containers), Equals, "16.6.1")
+}
+
+func (s *CleanupSuite) TestRetainHelperImages(c *C) {
+	s.dockerClient.images = []APIImages{
+		makeDockerHelperImage("v3", 3, "gitlab/gitlab-runner-helper:x86_64-v16.5.0"),
+		makeDockerHelperImage("v3-pwsh", 3, "gitlab/gitlab-runner-helper:x86_64-v16.5.0-pwsh"),
+		makeDockerHelperImage("v2", 2, "gitlab/gitlab-runner-helper:x86_64-v16.4.0"),
+		makeDockerHelperImage("v1", 1, "gitlab/gitlab-runner-helper:x86_64-v16.3.0"),
+		makeDockerImage("ruby:2.1"),
+	}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	retained := retainHelperImages(imagesUsed, "16.5.0", 1)
+	c.Assert(retained, DeepEquals, map[string]bool{"v3": true, "v3-pwsh": true, "v2": true})
+
+	retained = retainHelperImages(imagesUsed, "16.4.0", 0)
+	c.Assert(retained, DeepEquals, map[string]bool{"v2": true})
+
+	retained = retainHelperImages(imagesUsed, "16.6.0", 0)
+	c.Assert(retained, DeepEquals, map[string]bool{"v3": true, "v3-pwsh": true})
+
+	c.Assert(retainHelperImages(imagesUsed, "", 1), IsNil)
+	c.Assert(retainHelperImages(imagesUsed, "16.5.0", -1), IsNil)
+}
+
+func (s *CleanupSuite) TestOldHelperImagesAreRemoved(c *C) {
+	s.dockerClient.images = []APIImages{
+		makeDockerHelperImage("v2", 2, "gitlab/gitlab-runner-helper:x86_64-v16.5.0"),
+		makeDockerHelperImage("v1", 1, "gitlab/gitlab-runner-helper:x86_64-v16.4.0"),
+	}
+	s.dockerClient.containers = []APIContainers{
+		{ID: "runner", Image: "gitlab/gitlab-runner:v16.5.0", State: "running", Names: []string{"/runner"}},
+	}
+	opts.HelperImageVersions = 0
+	defer func() { opts.HelperImageVersions = 1 }()
+
+	c.Assert(isInternalImage(s.dockerClient.images[1]), Equals, true)
+
+	s.dockerClient.freeSpace = humanize.GByte
+	s.dockerClient.freeFiles = 100000
+	err := doCycle(s.dockerClient, humanize.MByte, humanize.GByte, 1000, 10000)
+	c.Assert(err, IsNil)
+	c.Assert(isInternalImage(s.dockerClient.images[0]), Equals, true)
+	c.Assert(isInternalImage(s.dockerClient.images[1]), Equals, false)
+
+	err = doFreeSpace(s.dockerClient, 2*humanize.GByte, 100000)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"v1"})
+}
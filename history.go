@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const maxImageHistoryUsers = 20
+const maxImageHistoryProjects = 20
+const untaggedImage = "<none>:<none>"
+
+type ImageUser struct {
+	ContainerID string       `json:"container_id"`
+	Job         RunnerLabels `json:"job"`
+	Time        time.Time    `json:"time"`
+}
+
+type ImageUsageHistory struct {
+	UseCount  int64       `json:"use_count"`
+	FirstSeen time.Time   `json:"first_seen"`
+	LastSeen  time.Time   `json:"last_seen"`
+	LastUsed  time.Time   `json:"last_used"`
+	Users     []ImageUser `json:"users,omitempty"`
+	Projects  []int64     `json:"projects,omitempty"`
+	Removed   time.Time   `json:"removed"`
+	Repulls   int64       `json:"repulls"`
+
+	Thrashes   int64     `json:"thrashes"`
+	LastThrash time.Time `json:"last_thrash"`
+}
+
+// imageHistories is keyed by the repository tags,
+// so the history survives removing and pulling the image again
+var imageHistories = make(map[string]*ImageUsageHistory)
+
+// the images removed and the images pulled again within the thrash window
+var imageRemovals, imageThrashes int64
+
+// historyLock guards the histories updated by the removal workers
+var historyLock sync.Mutex
+
+func thrashRate() float64 {
+	if imageRemovals == 0 {
+		return 0
+	}
+	return float64(imageThrashes) / float64(imageRemovals)
+}
+
+func imageHistoryKeys(image docker.APIImages) (keys []string) {
+	for _, tag := range image.RepoTags {
+		if tag != untaggedImage {
+			keys = append(keys, tag)
+		}
+	}
+	if len(keys) == 0 {
+		keys = append(keys, image.ID)
+	}
+	return
+}
+
+func imageHistory(key string) *ImageUsageHistory {
+	history := imageHistories[key]
+	if history == nil {
+		history = &ImageUsageHistory{}
+		imageHistories[key] = history
+	}
+	return history
+}
+
+func (h *ImageUsageHistory) addUser(user ImageUser) bool {
+	for idx := range h.Users {
+		if h.Users[idx].ContainerID == user.ContainerID {
+			h.Users[idx].Time = user.Time
+			return false
+		}
+	}
+
+	h.Users = append(h.Users, user)
+	if len(h.Users) > maxImageHistoryUsers {
+		h.Users = h.Users[len(h.Users)-maxImageHistoryUsers:]
+	}
+
+	if user.Job.ProjectID != 0 {
+		for idx, projectID := range h.Projects {
+			if projectID == user.Job.ProjectID {
+				h.Projects = append(h.Projects[:idx], h.Projects[idx+1:]...)
+				break
+			}
+		}
+		h.Projects = append(h.Projects, user.Job.ProjectID)
+		if len(h.Projects) > maxImageHistoryProjects {
+			h.Projects = h.Projects[len(h.Projects)-maxImageHistoryProjects:]
+		}
+	}
+	return true
+}
+
+func recordImageSeen(image docker.APIImages, now time.Time) bool {
+	thrashed := false
+	for _, key := range imageHistoryKeys(image) {
+		history := imageHistory(key)
+		if history.FirstSeen.IsZero() {
+			history.FirstSeen = now
+		}
+		if !history.Removed.IsZero() && imageArchive.restoredAfter(key, history.Removed) {
+			// loaded back by the tool itself, it wasn't pulled again by a job
+			logrus.WithFields(imageFields(image)).Infoln("Image", key, "was restored from the archive",
+				now.Sub(history.Removed), "after being removed")
+			history.Removed = time.Time{}
+		} else if !history.Removed.IsZero() {
+			history.Repulls++
+			if now.Sub(history.Removed) <= opts.ThrashWindow {
+				history.Thrashes++
+				history.LastThrash = now
+				thrashed = true
+				logrus.WithFields(imageFields(image)).Warningln("Image", key, "was pulled again",
+					now.Sub(history.Removed), "after being removed, extending its TTL")
+			} else {
+				logrus.WithFields(imageFields(image)).Infoln("Image", key, "was pulled again",
+					now.Sub(history.Removed), "after being removed")
+			}
+			history.Removed = time.Time{}
+		}
+		history.LastSeen = now
+	}
+
+	if thrashed {
+		imageThrashes++
+		logrus.WithField("thrash_rate", thrashRate()).Infoln(imageThrashes, "of", imageRemovals,
+			"removed images were pulled again within", opts.ThrashWindow)
+	}
+	return thrashed
+}
+
+func recordImageUse(image docker.APIImages, containerID string, job RunnerLabels, now time.Time) {
+	user := ImageUser{
+		ContainerID: containerID,
+		Job:         job,
+		Time:        now,
+	}
+	for _, key := range imageHistoryKeys(image) {
+		history := imageHistory(key)
+		if history.addUser(user) {
+			history.UseCount++
+		}
+		history.LastUsed = now
+	}
+}
+
+// recordImageRemoval remembers when the tags were removed to detect them being pulled again,
+// the history of untagged images can't be matched later so it's dropped
+func recordImageRemoval(image docker.APIImages, now time.Time) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	imageRemovals++
+
+	tagged := false
+	for _, tag := range image.RepoTags {
+		if tag != untaggedImage {
+			imageHistory(tag).Removed = now
+			tagged = true
+		}
+	}
+	if !tagged {
+		delete(imageHistories, image.ID)
+	}
+}
+
+func pruneImageHistories(now time.Time) {
+	for key, history := range imageHistories {
+		if now.Sub(history.LastSeen) > opts.ImageHistoryRetention {
+			delete(imageHistories, key)
+		}
+	}
+}
+
+// thrashes returns how many times the tags of the image were pulled again
+// shortly after being removed, only the thrashes within the history retention count
+func (i *ImageInfo) thrashes() (thrashes int64) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	for _, key := range imageHistoryKeys(i.APIImages) {
+		history, ok := imageHistories[key]
+		if ok && time.Since(history.LastThrash) < opts.ImageHistoryRetention {
+			thrashes += history.Thrashes
+		}
+	}
+	return
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (s *CleanupSuite) TestImageHistoryCountsJobs(c *C) {
+	build := makeDockerContainer("build", "test")
+	build.Labels = makeRunnerLabels(containerTypeBuild, "42")
+	s.dockerClient.containers = []APIContainers{build}
+	s.dockerClient.images = []APIImages{makeDockerImage("test")}
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	handleDockerContainerID(s.dockerClient, "build")
+	handleDockerContainerID(s.dockerClient, "build")
+
+	history := imageHistories["test"]
+	c.Assert(history, NotNil)
+	c.Assert(history.UseCount, Equals, int64(1))
+	c.Assert(history.Users, HasLen, 1)
+	c.Assert(history.Users[0].Job.JobID, Equals, int64(100))
+	c.Assert(history.Projects, DeepEquals, []int64{42})
+	c.Assert(history.LastUsed.IsZero(), Equals, false)
+}
+
+func (s *CleanupSuite) TestImageHistoryKeepsRecentUsers(c *C) {
+	history := &ImageUsageHistory{}
+	for i := 0; i < maxImageHistoryUsers+5; i++ {
+		history.addUser(ImageUser{ContainerID: string(rune('a' + i))})
+	}
+	c.Assert(history.Users, HasLen, maxImageHistoryUsers)
+	c.Assert(history.Users[0].ContainerID, Equals, string(rune('a'+5)))
+}
+
+func (s *CleanupSuite) TestImageHistoryDetectsRepulls(c *C) {
+	s.dockerClient.images = []APIImages{makeDockerImage("test")}
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	_, err = removeImage(s.dockerClient, imagesUsed["test"].APIImages)
+	c.Assert(err, IsNil)
+	c.Assert(imageHistories["test"].Removed.IsZero(), Equals, false)
+
+	s.dockerClient.images = []APIImages{makeDockerImage("test")}
+	err = updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imageHistories["test"].Repulls, Equals, int64(1))
+	c.Assert(imageHistories["test"].Removed.IsZero(), Equals, true)
+}
+
+func (s *CleanupSuite) TestImageHistoryIsPruned(c *C) {
+	imageHistories["gone"] = &ImageUsageHistory{
+		LastSeen: time.Now().Add(-2 * opts.ImageHistoryRetention),
+	}
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imageHistories, HasLen, 0)
+}
+
+func (s *CleanupSuite) TestThrashingImageGetsLongerTTL(c *C) {
+	opts.ThrashWindow = time.Hour
+	opts.ThrashTTL = time.Hour
+	s.dockerClient.images = []APIImages{makeDockerImage("test")}
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imagesUsed["test"].TTL.Before(time.Now().Add(time.Minute)), Equals, true)
+
+	_, err = removeImage(s.dockerClient, imagesUsed["test"].APIImages)
+	c.Assert(err, IsNil)
+
+	s.dockerClient.images = []APIImages{makeDockerImage("test")}
+	err = updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imageHistories["test"].Thrashes, Equals, int64(1))
+	c.Assert(imagesUsed["test"].TTL.After(time.Now().Add(59*time.Minute)), Equals, true)
+	c.Assert(thrashRate(), Equals, 1.0)
+}
+
+func (s *CleanupSuite) TestRestoredImageIsNotThrashing(c *C) {
+	s.openTestImageArchive(c, 1000, 0)
+	opts.ThrashWindow = time.Hour
+	image := makeDockerImageWithSize("ruby:2.3", 100)
+	s.dockerClient.images = []APIImages{image}
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	_, err = removeImage(s.dockerClient, image)
+	c.Assert(err, IsNil)
+	err = imageArchive.Restore(s.dockerClient, "ruby:2.3")
+	c.Assert(err, IsNil)
+
+	err = updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imageHistories["ruby:2.3"].Removed.IsZero(), Equals, true)
+	c.Assert(imageHistories["ruby:2.3"].Repulls, Equals, int64(0))
+	c.Assert(imageHistories["ruby:2.3"].Thrashes, Equals, int64(0))
+	c.Assert(imageThrashes, Equals, int64(0))
+}
+
+func (s *CleanupSuite) TestSlowRepullIsNotThrashing(c *C) {
+	opts.ThrashWindow = time.Hour
+	imageHistories["test"] = &ImageUsageHistory{
+		Removed: time.Now().Add(-2 * time.Hour),
+	}
+	s.dockerClient.images = []APIImages{makeDockerImage("test")}
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imageHistories["test"].Repulls, Equals, int64(1))
+	c.Assert(imageHistories["test"].Thrashes, Equals, int64(0))
+}
+
+func (s *CleanupSuite) TestThrashingImageHasLowerScore(c *C) {
+	image := ImageInfo{
+		APIImages: makeDockerImage("test"),
+		ObjectTTL: ObjectTTL{TTL: time.Now().Add(-time.Hour)},
+	}
+	score := image.score()
+
+	imageHistories["test"] = &ImageUsageHistory{
+		Thrashes:   1,
+		LastThrash: time.Now(),
+	}
+	c.Assert(image.score(), Equals, score/2)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+var runningBuilds int
+var deferredSince time.Time
+
+func isRunning(container docker.APIContainers) bool {
+	return container.State == "running" || strings.HasPrefix(container.Status, "Up")
+}
+
+func countRunningBuilds(containers []docker.APIContainers) (count int) {
+	for _, container := range containers {
+		if isRunning(container) && containerType(container.Names, container.Labels) == containerTypeBuild {
+			count++
+		}
+	}
+	return
+}
+
+// deferCleanup returns true while the builds are running,
+// the cleanup runs anyway once it was deferred for the max idle wait
+func deferCleanup(now time.Time) bool {
+	if !opts.WaitForIdle || runningBuilds == 0 {
+		deferredSince = time.Time{}
+		return false
+	}
+
+	if deferredSince.IsZero() {
+		deferredSince = now
+	}
+	if now.Sub(deferredSince) >= opts.MaxIdleWait {
+		logrus.Infoln("Cleanup deferred for", now.Sub(deferredSince), "while", runningBuilds, "builds are running, running it anyway")
+		deferredSince = now
+		return false
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func makeRunningBuildContainer(name string, image string) APIContainers {
+	container := makeDockerContainer(name, image)
+	container.State = "running"
+	container.Labels = makeRunnerLabels(containerTypeBuild, "1")
+	return container
+}
+
+func (s *CleanupSuite) TestCountRunningBuilds(c *C) {
+	stopped := makeDockerContainer("stopped", "image")
+	stopped.Labels = makeRunnerLabels(containerTypeBuild, "1")
+	service := makeDockerContainer("service", "image")
+	service.State = "running"
+	service.Labels = makeRunnerLabels(containerTypeService, "1")
+	legacy := makeDockerContainer("/runner-abcd1234-project-1-concurrent-0-build", "image")
+	legacy.Status = "Up 5 minutes"
+
+	c.Assert(countRunningBuilds([]APIContainers{
+		makeRunningBuildContainer("build", "image"),
+		stopped,
+		service,
+		legacy,
+	}), Equals, 2)
+}
+
+func (s *CleanupSuite) TestCleanupWaitsForIdle(c *C) {
+	opts.WaitForIdle = true
+	opts.MaxIdleWait = time.Hour
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("old", 1000),
+		makeDockerImage("image"),
+	}
+	s.dockerClient.containers = []APIContainers{makeRunningBuildContainer("build", "image")}
+	s.dockerClient.freeSpace = 600
+	s.dockerClient.freeFiles = 1000
+
+	err := doCycle(s.dockerClient, 1000, 2000, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, HasLen, 0)
+	c.Assert(runningBuilds, Equals, 1)
+
+	deferredSince = time.Now().Add(-2 * time.Hour)
+	err = doCycle(s.dockerClient, 1000, 2000, 0, 0)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedImages[0], Equals, "old")
+}
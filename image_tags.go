@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// updateTags tracks the usage of every tag, the tags
+// that are new to the image are marked as just used
+func (i *ImageInfo) updateTags(previous map[string]ObjectTTL, ttl time.Duration) {
+	i.Tags = make(map[string]ObjectTTL)
+	for _, tag := range i.RepoTags {
+		if tag == untaggedImage {
+			continue
+		}
+		tagTTL, ok := previous[tag]
+		if !ok {
+			tagTTL.mark(ttl)
+		}
+		i.Tags[tag] = tagTTL
+	}
+}
+
+// markImageTag marks the tag the container was created from,
+// all tags are marked when the container refers to the image by ID
+func markImageTag(id, name string) {
+	image, ok := imagesUsed[id]
+	if !ok || len(image.Tags) == 0 {
+		return
+	}
+
+	used := normalizeImageName(name)
+	_, byTag := image.Tags[used]
+	for tag, tagTTL := range image.Tags {
+		if !byTag || tag == used {
+			tagTTL.mark(opts.DefaultTTL)
+			image.Tags[tag] = tagTTL
+		}
+	}
+}
+
+// retainedTags splits the tags into the protected or recently used ones
+// and the stale ones that can be removed
+func (i *ImageInfo) retainedTags() (retained, stale []string) {
+	internal := make(map[string]bool)
+	for _, tag := range internalTags(i.APIImages) {
+		internal[tag] = true
+	}
+
+	for _, tag := range i.RepoTags {
+		if tag == untaggedImage {
+			continue
+		}
+		tagTTL, ok := i.Tags[tag]
+		if internal[tag] || (ok && tagTTL.score() < 0) {
+			retained = append(retained, tag)
+		} else {
+			stale = append(stale, tag)
+		}
+	}
+	return
+}
+
+// untagImage removes the stale tags of the image
+// without deleting the image used by its other tags
+func untagImage(client DockerClient, image docker.APIImages, retained, stale []string) error {
+	fields := imageFields(image)
+	fields["retained_tags"] = retained
+
+	var lastError error
+	for _, tag := range stale {
+		err := client.RemoveImageExtended(dockerContext, tag, docker.RemoveImageOptions{})
+		if err != nil {
+			logrus.WithFields(fields).Warningln("Failed to untag image", tag+":", strings.TrimSpace(err.Error()))
+			lastError = err
+			continue
+		}
+		logrus.WithFields(fields).Infoln("Untagged image", tag)
+		recordImageRemoval(docker.APIImages{ID: image.ID, RepoTags: []string{tag}}, time.Now())
+	}
+	if len(stale) == 0 {
+		logrus.WithFields(fields).Infoln("Image kept, all tags are retained")
+	}
+	return lastError
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func makeDockerMultiTagImage(id string, tags ...string) APIImages {
+	return APIImages{
+		ID:       id,
+		RepoTags: tags,
+		Size:     100,
+	}
+}
+
+func (s *CleanupSuite) TestImageTagUsage(c *C) {
+	s.dockerClient.images = []APIImages{makeDockerMultiTagImage("image", "ruby:2.3", "ruby:latest")}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imagesUsed["image"].Tags, HasLen, 2)
+
+	opts.DefaultTTL = time.Hour
+	markImageTag("image", "ruby")
+	c.Assert(imagesUsed["image"].Tags["ruby:latest"].TTL.After(time.Now()), Equals, true)
+	c.Assert(imagesUsed["image"].Tags["ruby:2.3"].TTL.After(time.Now()), Equals, false)
+
+	imageInfo := imagesUsed["image"]
+	retained, stale := imageInfo.retainedTags()
+	c.Assert(retained, DeepEquals, []string{"ruby:latest"})
+	c.Assert(stale, DeepEquals, []string{"ruby:2.3"})
+
+	err = updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imagesUsed["image"].Tags["ruby:latest"].TTL.After(time.Now()), Equals, true)
+}
+
+func (s *CleanupSuite) TestImageIsUntaggedWhenTagsAreRetained(c *C) {
+	s.dockerClient.images = []APIImages{makeDockerMultiTagImage("image", "ruby:2.3", "ruby:latest")}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	imagesUsed["image"].Tags["ruby:latest"] = ObjectTTL{TTL: time.Now().Add(time.Hour)}
+
+	_, err = removeImage(s.dockerClient, imagesUsed["image"].APIImages)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"ruby:2.3"})
+	c.Assert(imageHistories["ruby:2.3"].Removed.IsZero(), Equals, false)
+}
+
+func (s *CleanupSuite) TestStaleTagsOfInternalImagesAreRemoved(c *C) {
+	s.dockerClient.images = []APIImages{makeDockerMultiTagImage("image", "gitlab/gitlab-runner:latest", "stale:1")}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	err = doFreeSpace(s.dockerClient, 1000, 0)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"stale:1"})
+}
+
+func (s *CleanupSuite) TestUntaggedImageKeepsItsParents(c *C) {
+	path := s.openTestAuditLog(c, 0, 0)
+
+	image := makeDockerMultiTagImage("image", "ruby:2.3", "ruby:latest")
+	image.ParentID = "base"
+	s.dockerClient.images = []APIImages{makeDockerImage("base"), image}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	imagesUsed["image"].Tags["ruby:latest"] = ObjectTTL{TTL: time.Now().Add(time.Hour)}
+
+	err = doFreeSpace(s.dockerClient, 1000, 0)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"ruby:2.3"})
+
+	records := readAuditRecords(c, path)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Action, Equals, "untag-image")
+	c.Assert(records[0].Names, DeepEquals, []string{"ruby:2.3"})
+	c.Assert(records[0].Size, Equals, int64(0))
+}
+
+func (s *CleanupSuite) TestUntagCountsAsRemoval(c *C) {
+	opts.MaxRemovalsPerCycle = 1
+	cycleBudget = newCycleBudget()
+	s.dockerClient.images = []APIImages{
+		makeDockerMultiTagImage("image", "ruby:2.3", "ruby:latest"),
+		makeDockerImageWithSize("other", 100),
+	}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	imagesUsed["image"].Tags["ruby:latest"] = ObjectTTL{TTL: time.Now().Add(time.Hour)}
+	image := imagesUsed["image"]
+	image.TTL = time.Now().Add(-time.Hour)
+	imagesUsed["image"] = image
+
+	err = doFreeSpace(s.dockerClient, 1000, 0)
+	c.Assert(err, Equals, errBudgetExhausted)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"ruby:2.3"})
+}
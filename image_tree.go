@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+)
+
+type ImageTree struct {
+	images   map[string]docker.APIImages
+	children map[string][]string
+}
+
+func newImageTree(images []docker.APIImages) *ImageTree {
+	tree := &ImageTree{
+		images:   make(map[string]docker.APIImages),
+		children: make(map[string][]string),
+	}
+	for _, image := range images {
+		tree.images[image.ID] = image
+	}
+	for _, image := range images {
+		if _, ok := tree.images[image.ParentID]; ok {
+			tree.children[image.ParentID] = append(tree.children[image.ParentID], image.ID)
+		}
+	}
+	return tree
+}
+
+func isUntagged(image docker.APIImages) bool {
+	for _, tag := range image.RepoTags {
+		if tag != untaggedImage {
+			return false
+		}
+	}
+	return true
+}
+
+// isLeaf returns true for images without children,
+// the images with children can't be removed before their children
+func (t *ImageTree) isLeaf(id string) bool {
+	return len(t.children[id]) == 0
+}
+
+// ownSize returns the size of the layers added on top of the parent image
+func (t *ImageTree) ownSize(id string) int64 {
+	image := t.images[id]
+	parent, ok := t.images[image.ParentID]
+	if !ok || parent.Size > image.Size {
+		return image.Size
+	}
+	return image.Size - parent.Size
+}
+
+// removedWith returns the untagged parents that docker removes together with the image
+func (t *ImageTree) removedWith(id string) (parents []string) {
+	for {
+		parentID := t.images[id].ParentID
+		parent, ok := t.images[parentID]
+		if !ok || !isUntagged(parent) || len(t.children[parentID]) != 1 {
+			return
+		}
+		parents = append(parents, parentID)
+		id = parentID
+	}
+}
+
+// reclaimableSize returns the bytes that are not shared with other images
+// and would be freed by removing the image
+func (t *ImageTree) reclaimableSize(id string) int64 {
+	size := t.ownSize(id)
+	for _, parentID := range t.removedWith(id) {
+		size += t.ownSize(parentID)
+	}
+	return size
+}
+
+func (t *ImageTree) ancestors(id string) (parents []string) {
+	for {
+		parentID := t.images[id].ParentID
+		if _, ok := t.images[parentID]; !ok {
+			return
+		}
+		parents = append(parents, parentID)
+		id = parentID
+	}
+}
+
+// withoutImage drops the image from the candidates. A removed image takes
+// its untagged parents with it, the parents of an image that failed
+// to be removed can't be removed either.
+func withoutImage(images []docker.APIImages, id string, removed bool) []docker.APIImages {
+	tree := newImageTree(images)
+	dropped := map[string]bool{id: true}
+	parents := tree.ancestors(id)
+	if removed {
+		parents = tree.removedWith(id)
+	}
+	for _, parentID := range parents {
+		dropped[parentID] = true
+	}
+
+	var result []docker.APIImages
+	for _, image := range images {
+		if !dropped[image.ID] {
+			result = append(result, image)
+		}
+	}
+	return result
+}
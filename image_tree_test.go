@@ -0,0 +1,57 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func makeDockerImageTree() []APIImages {
+	base := makeDockerImageWithSize("base", 100)
+	intermediate := APIImages{ID: "intermediate", RepoTags: []string{untaggedImage}, ParentID: "base", Size: 150}
+	child := makeDockerImageWithSize("child", 200)
+	child.ParentID = "intermediate"
+	other := makeDockerImageWithSize("other", 130)
+	other.ParentID = "base"
+	return []APIImages{base, intermediate, child, other}
+}
+
+func (s *CleanupSuite) TestImageTreeReclaimableSize(c *C) {
+	tree := newImageTree(makeDockerImageTree())
+	c.Assert(tree.isLeaf("base"), Equals, false)
+	c.Assert(tree.isLeaf("child"), Equals, true)
+	c.Assert(tree.ownSize("child"), Equals, int64(50))
+	c.Assert(tree.removedWith("child"), DeepEquals, []string{"intermediate"})
+	c.Assert(tree.reclaimableSize("child"), Equals, int64(100))
+	c.Assert(tree.reclaimableSize("other"), Equals, int64(30))
+}
+
+func (s *CleanupSuite) TestWithoutImage(c *C) {
+	images := withoutImage(makeDockerImageTree(), "child", true)
+	c.Assert(images, HasLen, 2)
+	c.Assert(newImageTree(images).isLeaf("base"), Equals, false)
+
+	images = withoutImage(makeDockerImageTree(), "child", false)
+	c.Assert(images, HasLen, 1)
+	c.Assert(images[0].ID, Equals, "other")
+}
+
+func (s *CleanupSuite) TestParentImagesAreRemovedAfterChildren(c *C) {
+	s.dockerClient.images = makeDockerImageTree()
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	base := imagesUsed["base"]
+	base.TTL = time.Now().Add(-time.Hour)
+	imagesUsed["base"] = base
+
+	bestImageIndex, _, _ := findBestCandidate(s.dockerClient.images, nil, nil)
+	c.Assert(bestImageIndex, Not(Equals), 0)
+	c.Assert(s.dockerClient.images[bestImageIndex].ID, Not(Equals), "intermediate")
+
+	s.dockerClient.freeSpace = 0
+	err = doFreeSpace(s.dockerClient, 1000, 0)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedImages[len(s.dockerClient.removedImages)-1], Equals, "base")
+	c.Assert(s.dockerClient.removedImages, HasLen, 3)
+}
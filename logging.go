@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func setupLogging(c *cli.Context) error {
+	level, err := logrus.ParseLevel(opts.LogLevel)
+	if err != nil {
+		return err
+	}
+	logrus.SetLevel(level)
+
+	switch opts.LogFormat {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format: %q", opts.LogFormat)
+	}
+	return nil
+}
+
+func imageFields(image docker.APIImages) logrus.Fields {
+	fields := logrus.Fields{
+		"image": image.ID,
+		"tags":  image.RepoTags,
+		"bytes": image.Size,
+	}
+	if imageInfo, ok := imagesUsed[image.ID]; ok {
+		fields["score"] = imageInfo.score()
+	}
+	return fields
+}
+
+func cacheFields(cache CacheInfo) logrus.Fields {
+	fields := cache.Name.fields()
+	fields["cache"] = cache.ID
+	fields["names"] = cache.Names
+	fields["bytes"] = cache.size()
+	if cache.Volume {
+		fields["volume"] = true
+	}
+	if cacheInfo, ok := cachesUsed[cache.ID]; ok {
+		fields["score"] = cacheInfo.score()
+	}
+	return fields
+}
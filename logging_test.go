@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	. "gopkg.in/check.v1"
+)
+
+func (s *CleanupSuite) TestSetupLogging(c *C) {
+	defer logrus.SetFormatter(&logrus.TextFormatter{})
+
+	opts.LogLevel = "warning"
+	opts.LogFormat = "json"
+	err := setupLogging(nil)
+	c.Assert(err, IsNil)
+	c.Assert(logrus.GetLevel(), Equals, logrus.WarnLevel)
+	c.Assert(logrus.StandardLogger().Formatter, FitsTypeOf, &logrus.JSONFormatter{})
+
+	opts.LogFormat = "xml"
+	err = setupLogging(nil)
+	c.Assert(err, NotNil)
+
+	opts.LogLevel = "unknown"
+	opts.LogFormat = "text"
+	err = setupLogging(nil)
+	c.Assert(err, NotNil)
+}
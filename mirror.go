@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const mirrorCheckTimeout = 10 * time.Second
+
+// mirrorLookupTTL is how long a tag found or missing in the mirror is not checked again
+const mirrorLookupTTL = time.Hour
+
+var errMirrorFailed = errors.New("registry mirror failed earlier in this check")
+
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// mirrorLookup is the digest of the manifest found in the mirror, empty when the tag is missing,
+// or the image pushed to the tag by the tool
+type mirrorLookup struct {
+	digest   string
+	pushedID string
+	checked  time.Time
+}
+
+// matches checks if the tag in the mirror is the image and not another image with the same tag
+func (l mirrorLookup) matches(image docker.APIImages) bool {
+	if l.pushedID != "" {
+		return l.pushedID == image.ID
+	}
+	if l.digest == "" {
+		return false
+	}
+	for _, repoDigest := range image.RepoDigests {
+		if strings.HasSuffix(repoDigest, "@"+l.digest) {
+			return true
+		}
+	}
+	return false
+}
+
+type RegistryMirror struct {
+	registry   string
+	scheme     string
+	httpClient *http.Client
+
+	lock    sync.Mutex
+	lookups map[string]mirrorLookup
+	failed  bool
+}
+
+var registryMirror *RegistryMirror
+
+func newRegistryMirror(registry string) *RegistryMirror {
+	registry = strings.TrimSuffix(registry, "/")
+
+	// the docker daemon only talks plain http to the registries on the loopback
+	scheme := "https"
+	host, _, err := net.SplitHostPort(registry)
+	if err != nil {
+		host = registry
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+
+	return &RegistryMirror{
+		registry: registry,
+		scheme:   scheme,
+		httpClient: &http.Client{
+			Timeout: mirrorCheckTimeout,
+		},
+		lookups: make(map[string]mirrorLookup),
+	}
+}
+
+// startCheck lets the mirror be queried again after it failed in the previous check
+func (m *RegistryMirror) startCheck() {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.failed = false
+}
+
+func (m *RegistryMirror) isMirrorTag(tag string) bool {
+	return strings.HasPrefix(tag, m.registry+"/")
+}
+
+// splitRegistry splits the registry host from the repository, empty for Docker Hub
+func splitRegistry(repository string) (registry, path string) {
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, path = parts[0], parts[1]
+	} else {
+		path = repository
+	}
+	switch registry {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		registry = ""
+	}
+	return
+}
+
+// isDockerHubRepository checks if the mirror can take the repository, the mirror works like
+// a pull-through cache of Docker Hub, the same paths of other registries would collide there
+func isDockerHubRepository(repository string) bool {
+	registry, _ := splitRegistry(repository)
+	return registry == ""
+}
+
+// mirrorRepository maps the Docker Hub repository to the mirror
+// the same way as a pull-through cache does
+func (m *RegistryMirror) mirrorRepository(repository string) string {
+	_, path := splitRegistry(repository)
+	if !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return m.registry + "/" + path
+}
+
+// manifestDigest returns the digest of the tag in the mirror, empty when it's missing
+func (m *RegistryMirror) manifestDigest(repository, tag string) (string, error) {
+	path := strings.TrimPrefix(repository, m.registry+"/")
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("%s://%s/v2/%s/manifests/%s", m.scheme, m.registry, path, tag), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("Docker-Content-Digest"), nil
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("unexpected status %s from %s", resp.Status, m.registry)
+	}
+}
+
+// lookup checks the tag in the mirror, the results are cached and
+// the mirror isn't queried anymore in this check once it failed
+func (m *RegistryMirror) lookup(repository, tag string) (mirrorLookup, error) {
+	key := repository + ":" + tag
+
+	m.lock.Lock()
+	if cached, ok := m.lookups[key]; ok && time.Since(cached.checked) < mirrorLookupTTL {
+		m.lock.Unlock()
+		return cached, nil
+	}
+	failed := m.failed
+	m.lock.Unlock()
+	if failed {
+		return mirrorLookup{}, errMirrorFailed
+	}
+
+	digest, err := m.manifestDigest(repository, tag)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err != nil {
+		m.failed = true
+		return mirrorLookup{}, err
+	}
+	lookup := mirrorLookup{digest: digest, checked: time.Now()}
+	m.lookups[key] = lookup
+	return lookup, nil
+}
+
+func (m *RegistryMirror) remember(repository, tag string, image docker.APIImages) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lookups[repository+":"+tag] = mirrorLookup{pushedID: image.ID, checked: time.Now()}
+}
+
+// tagsToPush returns the Docker Hub tags of the image, the tags
+// of other registries and of the mirror itself are not mirrored
+func (m *RegistryMirror) tagsToPush(image docker.APIImages) (tags []string) {
+	for _, tag := range image.RepoTags {
+		if tag == untaggedImage || m.isMirrorTag(tag) {
+			continue
+		}
+		repository, _ := docker.ParseRepositoryTag(tag)
+		if isDockerHubRepository(repository) {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// Contains checks if all tags of the image can be pulled from the mirror
+func (m *RegistryMirror) Contains(image docker.APIImages) bool {
+	if m == nil {
+		return false
+	}
+
+	tags := m.tagsToPush(image)
+	if len(tags) == 0 {
+		return false
+	}
+	for _, tag := range tags {
+		repository, tagName := docker.ParseRepositoryTag(tag)
+		lookup, err := m.lookup(m.mirrorRepository(repository), tagName)
+		if err != nil {
+			logrus.Debugln("Failed to check", tag, "in the mirror:", err)
+		}
+		if !lookup.matches(image) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *RegistryMirror) Push(client DockerClient, image docker.APIImages) error {
+	if m == nil {
+		return nil
+	}
+
+	for _, tag := range m.tagsToPush(image) {
+		repository, tagName := docker.ParseRepositoryTag(tag)
+		mirrorRepository := m.mirrorRepository(repository)
+
+		lookup, err := m.lookup(mirrorRepository, tagName)
+		if err == errMirrorFailed {
+			return err
+		} else if err != nil {
+			logrus.Debugln("Failed to check", tag, "in the mirror:", err)
+		}
+		if lookup.matches(image) {
+			continue
+		}
+
+		err = client.TagImage(dockerContext, image.ID, docker.TagImageOptions{
+			Repo:  mirrorRepository,
+			Tag:   tagName,
+			Force: true,
+		})
+		if err != nil {
+			return err
+		}
+		err = client.PushImage(dockerContext, docker.PushImageOptions{
+			Name: mirrorRepository,
+			Tag:  tagName,
+		}, docker.AuthConfiguration{})
+		if err != nil {
+			return err
+		}
+		m.remember(mirrorRepository, tagName, image)
+		logrus.WithFields(imageFields(image)).Infoln("Pushed", tag, "to", mirrorRepository+":"+tagName)
+	}
+	return nil
+}
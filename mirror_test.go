@@ -0,0 +1,172 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// testMirrorDigest is the digest of all manifests in the test registry
+const testMirrorDigest = "sha256:mirrored"
+
+func makeMirroredImage(tag string) APIImages {
+	image := makeDockerImage(tag)
+	repository, _ := ParseRepositoryTag(tag)
+	image.RepoDigests = []string{repository + "@" + testMirrorDigest}
+	return image
+}
+
+func (s *CleanupSuite) startTestRegistry(c *C, manifests ...string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, http.MethodHead)
+		for _, manifest := range manifests {
+			if r.URL.Path == "/v2/"+manifest {
+				w.Header().Set("Docker-Content-Digest", testMirrorDigest)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	registryMirror = newRegistryMirror(strings.TrimPrefix(server.URL, "http://"))
+	return server
+}
+
+func (s *CleanupSuite) TestMirrorRepository(c *C) {
+	mirror := newRegistryMirror("localhost:5000")
+	c.Assert(mirror.scheme, Equals, "http")
+	c.Assert(mirror.mirrorRepository("ruby"), Equals, "localhost:5000/library/ruby")
+	c.Assert(mirror.mirrorRepository("gitlab/gitlab-runner"), Equals, "localhost:5000/gitlab/gitlab-runner")
+	c.Assert(mirror.mirrorRepository("docker.io/library/ruby"), Equals, "localhost:5000/library/ruby")
+	c.Assert(mirror.mirrorRepository("docker.io/ruby"), Equals, "localhost:5000/library/ruby")
+	c.Assert(isDockerHubRepository("gitlab/gitlab-runner"), Equals, true)
+	c.Assert(isDockerHubRepository("registry.gitlab.com/group/project"), Equals, false)
+	c.Assert(isDockerHubRepository("ghcr.io/group/project"), Equals, false)
+	c.Assert(isDockerHubRepository("localhost:5000/group/project"), Equals, false)
+	c.Assert(mirror.isMirrorTag("localhost:5000/library/ruby:2.3"), Equals, true)
+	c.Assert(mirror.isMirrorTag("ruby:2.3"), Equals, false)
+
+	c.Assert(newRegistryMirror("mirror.example.com").scheme, Equals, "https")
+}
+
+func (s *CleanupSuite) TestImageIsPushedToMirrorBeforeRemoval(c *C) {
+	server := s.startTestRegistry(c, "library/alpine/manifests/3.4")
+	defer server.Close()
+
+	image := APIImages{
+		ID:          "image",
+		RepoTags:    []string{"ruby:2.3", "alpine:3.4", "registry.gitlab.com/group/project:1"},
+		RepoDigests: []string{"alpine@" + testMirrorDigest},
+	}
+	_, err := removeImage(s.dockerClient, image)
+	c.Assert(err, IsNil)
+
+	mirrorTag := registryMirror.registry + "/library/ruby:2.3"
+	c.Assert(s.dockerClient.taggedImages, DeepEquals, []string{mirrorTag})
+	c.Assert(s.dockerClient.pushedImages, DeepEquals, []string{mirrorTag})
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"image"})
+}
+
+func (s *CleanupSuite) TestMirrorImagesAreNotPushed(c *C) {
+	server := s.startTestRegistry(c)
+	defer server.Close()
+
+	image := makeDockerImage(registryMirror.registry + "/library/ruby:2.3")
+	_, err := removeImage(s.dockerClient, image)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.pushedImages, HasLen, 0)
+}
+
+func (s *CleanupSuite) TestMirroredImagesAreCheaperToEvict(c *C) {
+	server := s.startTestRegistry(c, "library/ruby/manifests/2.3")
+	defer server.Close()
+
+	s.dockerClient.images = []APIImages{makeMirroredImage("ruby:2.3"), makeDockerImage("alpine:3.4")}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imagesUsed["ruby:2.3"].Mirrored, Equals, true)
+	c.Assert(imagesUsed["alpine:3.4"].Mirrored, Equals, false)
+
+	ruby := imagesUsed["ruby:2.3"]
+	ruby.TTL = time.Now().Add(-time.Minute)
+	alpine := imagesUsed["alpine:3.4"]
+	alpine.TTL = ruby.TTL
+	c.Assert(ruby.score() > alpine.score(), Equals, true)
+
+	_, err = removeImage(s.dockerClient, ruby.APIImages)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.pushedImages, HasLen, 0)
+}
+
+func (s *CleanupSuite) TestMirrorLookupsAreCached(c *C) {
+	var requests int
+	server := s.startTestRegistry(c, "library/ruby/manifests/2.3")
+	defer server.Close()
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		handler.ServeHTTP(w, r)
+	})
+
+	c.Assert(registryMirror.Contains(makeMirroredImage("ruby:2.3")), Equals, true)
+	c.Assert(registryMirror.Contains(makeDockerImage("alpine:3.4")), Equals, false)
+	c.Assert(registryMirror.Contains(makeMirroredImage("ruby:2.3")), Equals, true)
+	c.Assert(registryMirror.Contains(makeDockerImage("alpine:3.4")), Equals, false)
+	c.Assert(requests, Equals, 2)
+
+	_, err := removeImage(s.dockerClient, makeDockerImage("alpine:3.4"))
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.pushedImages, HasLen, 1)
+	c.Assert(registryMirror.Contains(makeDockerImage("alpine:3.4")), Equals, true)
+	c.Assert(requests, Equals, 2)
+}
+
+func (s *CleanupSuite) TestFailedMirrorIsSkippedForTheCheck(c *C) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	registryMirror = newRegistryMirror(strings.TrimPrefix(server.URL, "http://"))
+
+	c.Assert(registryMirror.Contains(makeDockerImage("ruby:2.3")), Equals, false)
+	c.Assert(registryMirror.Contains(makeDockerImage("alpine:3.4")), Equals, false)
+	c.Assert(requests, Equals, 1)
+
+	err := registryMirror.Push(s.dockerClient, makeDockerImage("alpine:3.4"))
+	c.Assert(err, Equals, errMirrorFailed)
+	c.Assert(s.dockerClient.pushedImages, HasLen, 0)
+
+	registryMirror.startCheck()
+	c.Assert(registryMirror.Contains(makeDockerImage("alpine:3.4")), Equals, false)
+	c.Assert(requests, Equals, 2)
+}
+
+func (s *CleanupSuite) TestOtherImageWithTheSameTagIsPushed(c *C) {
+	server := s.startTestRegistry(c, "library/ruby/manifests/2.3")
+	defer server.Close()
+
+	image := makeDockerImage("ruby:2.3")
+	image.RepoDigests = []string{"ruby@sha256:other"}
+	c.Assert(registryMirror.Contains(image), Equals, false)
+
+	_, err := removeImage(s.dockerClient, image)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.pushedImages, DeepEquals, []string{registryMirror.registry + "/library/ruby:2.3"})
+}
+
+func (s *CleanupSuite) TestOtherRegistriesAreNotMirrored(c *C) {
+	server := s.startTestRegistry(c, "group/project/manifests/1")
+	defer server.Close()
+
+	image := makeMirroredImage("ghcr.io/group/project:1")
+	c.Assert(registryMirror.Contains(image), Equals, false)
+
+	_, err := removeImage(s.dockerClient, image)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.pushedImages, HasLen, 0)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	eventCleanupStarted    = "cleanup_started"
+	eventCleanupCompleted  = "cleanup_completed"
+	eventTargetNotReached  = "target_not_reached"
+	eventDaemonUnreachable = "daemon_unreachable"
+)
+
+const defaultWebhookTemplate = "[{{.Host}}] {{.Message}}"
+const webhookTimeout = 10 * time.Second
+const webhookRetryDelay = time.Second
+
+type Notification struct {
+	Event      string    `json:"event"`
+	Host       string    `json:"host"`
+	Time       time.Time `json:"time"`
+	Message    string    `json:"message"`
+	BytesFree  uint64    `json:"bytes_free,omitempty"`
+	BytesFreed uint64    `json:"bytes_freed,omitempty"`
+	FilesFreed uint64    `json:"files_freed,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Text       string    `json:"text"`
+}
+
+type slackPayload struct {
+	Text string `json:"text"`
+}
+
+type Notifier struct {
+	url        string
+	format     string
+	template   *template.Template
+	events     map[string]bool
+	rateLimit  time.Duration
+	retries    int
+	retryDelay time.Duration
+	client     *http.Client
+
+	lock     sync.Mutex
+	lastSent map[string]time.Time
+}
+
+var notifier *Notifier
+
+func newNotifier(url, format, text, events string, rateLimit time.Duration, retries int) (*Notifier, error) {
+	if format != "generic" && format != "slack" {
+		return nil, fmt.Errorf("unknown webhook format: %q", format)
+	}
+
+	if text == "" {
+		text = defaultWebhookTemplate
+	}
+	tmpl, err := template.New("webhook").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Notifier{
+		url:        url,
+		format:     format,
+		template:   tmpl,
+		rateLimit:  rateLimit,
+		retries:    retries,
+		retryDelay: webhookRetryDelay,
+		client: &http.Client{
+			Timeout: webhookTimeout,
+		},
+		lastSent: make(map[string]time.Time),
+	}
+
+	if events != "" {
+		n.events = make(map[string]bool)
+		for _, event := range strings.Split(events, ",") {
+			n.events[strings.TrimSpace(event)] = true
+		}
+	}
+	return n, nil
+}
+
+func (n *Notifier) allow(event string, now time.Time) bool {
+	if n.events != nil && !n.events[event] {
+		return false
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if last, ok := n.lastSent[event]; ok && now.Sub(last) < n.rateLimit {
+		return false
+	}
+	n.lastSent[event] = now
+	return true
+}
+
+func (n *Notifier) payload(notification Notification) ([]byte, error) {
+	var text bytes.Buffer
+	err := n.template.Execute(&text, notification)
+	if err != nil {
+		return nil, err
+	}
+	notification.Text = text.String()
+
+	if n.format == "slack" {
+		return json.Marshal(slackPayload{Text: notification.Text})
+	}
+	return json.Marshal(notification)
+}
+
+func (n *Notifier) post(data []byte) error {
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) deliver(notification Notification) error {
+	data, err := n.payload(notification)
+	if err != nil {
+		return err
+	}
+
+	delay := n.retryDelay
+	for attempt := 0; ; attempt++ {
+		err = n.post(data)
+		if err == nil || attempt >= n.retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (n *Notifier) Notify(notification Notification) {
+	if n == nil {
+		return
+	}
+
+	if notification.Time.IsZero() {
+		notification.Time = time.Now()
+	}
+	if notification.Host == "" {
+		notification.Host, _ = os.Hostname()
+	}
+	if !n.allow(notification.Event, notification.Time) {
+		logrus.Debugln("Skipping notification", notification.Event)
+		return
+	}
+
+	go func() {
+		err := n.deliver(notification)
+		if err != nil {
+			logrus.Warningln("Failed to send", notification.Event, "notification:", err)
+		}
+	}()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func newTestWebhook(c *C, failures int, payloads *[]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		var payload map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		c.Check(err, IsNil)
+		*payloads = append(*payloads, payload)
+	}))
+}
+
+func (s *CleanupSuite) TestNotifierGenericPayload(c *C) {
+	var payloads []map[string]interface{}
+	server := newTestWebhook(c, 0, &payloads)
+	defer server.Close()
+
+	n, err := newNotifier(server.URL, "generic", "", "", 0, 0)
+	c.Assert(err, IsNil)
+
+	err = n.deliver(Notification{
+		Event:      eventCleanupCompleted,
+		Host:       "runner",
+		Message:    "Cleanup completed",
+		BytesFreed: 1024,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(payloads, HasLen, 1)
+	c.Assert(payloads[0]["event"], Equals, eventCleanupCompleted)
+	c.Assert(payloads[0]["bytes_freed"], Equals, float64(1024))
+	c.Assert(payloads[0]["text"], Equals, "[runner] Cleanup completed")
+}
+
+func (s *CleanupSuite) TestNotifierSlackPayloadWithTemplate(c *C) {
+	var payloads []map[string]interface{}
+	server := newTestWebhook(c, 0, &payloads)
+	defer server.Close()
+
+	n, err := newNotifier(server.URL, "slack", "{{.Event}} on {{.Host}}", "", 0, 0)
+	c.Assert(err, IsNil)
+
+	err = n.deliver(Notification{
+		Event: eventTargetNotReached,
+		Host:  "runner",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(payloads, HasLen, 1)
+	c.Assert(payloads[0], DeepEquals, map[string]interface{}{
+		"text": "target_not_reached on runner",
+	})
+}
+
+func (s *CleanupSuite) TestNotifierRetries(c *C) {
+	var payloads []map[string]interface{}
+	server := newTestWebhook(c, 2, &payloads)
+	defer server.Close()
+
+	n, err := newNotifier(server.URL, "generic", "", "", 0, 1)
+	c.Assert(err, IsNil)
+	n.retryDelay = time.Millisecond
+
+	err = n.deliver(Notification{Event: eventCleanupStarted})
+	c.Assert(err, NotNil)
+	c.Assert(payloads, HasLen, 0)
+
+	err = n.deliver(Notification{Event: eventCleanupStarted})
+	c.Assert(err, IsNil)
+	c.Assert(payloads, HasLen, 1)
+}
+
+func (s *CleanupSuite) TestNotifierRateLimitAndEvents(c *C) {
+	n, err := newNotifier("http://localhost", "generic", "", eventCleanupStarted+","+eventDaemonUnreachable, time.Minute, 0)
+	c.Assert(err, IsNil)
+
+	now := time.Now()
+	c.Assert(n.allow(eventCleanupCompleted, now), Equals, false)
+	c.Assert(n.allow(eventCleanupStarted, now), Equals, true)
+	c.Assert(n.allow(eventCleanupStarted, now.Add(time.Second)), Equals, false)
+	c.Assert(n.allow(eventDaemonUnreachable, now.Add(time.Second)), Equals, true)
+	c.Assert(n.allow(eventCleanupStarted, now.Add(2*time.Minute)), Equals, true)
+}
+
+func (s *CleanupSuite) TestNotifierInvalidFormat(c *C) {
+	_, err := newNotifier("http://localhost", "xml", "", "", 0, 0)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const anyProject = -1
+
+type CacheQuota struct {
+	MaxBytes uint64
+	MaxCount int
+}
+
+func (q CacheQuota) exceeded(usage projectCacheUsage) bool {
+	return (q.MaxBytes > 0 && uint64(usage.bytes) > q.MaxBytes) ||
+		(q.MaxCount > 0 && usage.count > q.MaxCount)
+}
+
+var cacheQuotas map[int64]CacheQuota
+
+// parseCacheQuotas parses the comma separated list of <project id>:<max size>:<max count>,
+// where the project id can be * to match all other projects and either limit can be empty
+func parseCacheQuotas(quotas string) (map[int64]CacheQuota, error) {
+	if quotas == "" {
+		return nil, nil
+	}
+
+	result := make(map[int64]CacheQuota)
+	for _, rule := range strings.Split(quotas, ",") {
+		parts := strings.Split(strings.TrimSpace(rule), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid cache quota %q, expected <project id>:<max size>:<max count>", rule)
+		}
+
+		projectID := int64(anyProject)
+		if parts[0] != "*" {
+			id, err := strconv.ParseInt(parts[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid project ID in cache quota %q", rule)
+			}
+			projectID = id
+		}
+
+		var quota CacheQuota
+		if parts[1] != "" {
+			maxBytes, err := humanize.ParseBytes(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid size in cache quota %q: %v", rule, err)
+			}
+			quota.MaxBytes = maxBytes
+		}
+		if parts[2] != "" {
+			maxCount, err := strconv.Atoi(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid count in cache quota %q", rule)
+			}
+			quota.MaxCount = maxCount
+		}
+		result[projectID] = quota
+	}
+	return result, nil
+}
+
+func cacheQuotaFor(projectID int64) (CacheQuota, bool) {
+	if quota, ok := cacheQuotas[projectID]; ok {
+		return quota, true
+	}
+	quota, ok := cacheQuotas[anyProject]
+	return quota, ok
+}
+
+func cacheSizesNeeded() bool {
+	if opts.FairCacheEviction {
+		return true
+	}
+	for _, quota := range cacheQuotas {
+		if quota.MaxBytes > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func directorySize(path string) (size int64) {
+	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// measureCacheSize sums the container layer and the data of all volumes
+// of the cache. The volumes are measured through their host paths,
+// so the sizes are only known when the tool runs on the docker host.
+func measureCacheSize(cache CacheInfo) int64 {
+	size := cache.SizeRw
+	for _, mount := range cache.Mounts {
+		if mount.Source != "" {
+			size += directorySize(mount.Source)
+		}
+	}
+	return size
+}
+
+// cacheSizeOutdated returns true for the caches that were never measured and the caches
+// used since their last measurement, which are measured again at most every measure interval
+func cacheSizeOutdated(cache CacheInfo, now time.Time) bool {
+	return cache.Measured.IsZero() ||
+		(cache.Used.After(cache.Measured) && now.Sub(cache.Measured) >= opts.CacheMeasureInterval)
+}
+
+type projectCacheUsage struct {
+	projectID int64
+	bytes     int64
+	count     int
+	caches    []CacheInfo
+}
+
+func cacheUsageByProject(caches []CacheInfo) map[int64]*projectCacheUsage {
+	projects := make(map[int64]*projectCacheUsage)
+	for _, cache := range caches {
+		if cacheInfo, ok := cachesUsed[cache.ID]; ok {
+			cache = cacheInfo
+		}
+		if isProtectedCache(cache.Name) {
+			continue
+		}
+
+		usage := projects[cache.Name.ProjectID]
+		if usage == nil {
+			usage = &projectCacheUsage{projectID: cache.Name.ProjectID}
+			projects[cache.Name.ProjectID] = usage
+		}
+		usage.bytes += cache.size()
+		usage.count++
+		usage.caches = append(usage.caches, cache)
+	}
+
+	for _, usage := range projects {
+		sort.SliceStable(usage.caches, func(i, j int) bool {
+			return usage.caches[i].score() > usage.caches[j].score()
+		})
+	}
+	return projects
+}
+
+// fairCacheCandidate returns the cache to evict from the project
+// that uses the biggest part of its equal share of the caches
+func fairCacheCandidate(caches []CacheInfo) (string, bool) {
+	projects := cacheUsageByProject(caches)
+	if len(projects) < 2 {
+		return "", false
+	}
+
+	var totalBytes int64
+	var totalCount int
+	for _, usage := range projects {
+		totalBytes += usage.bytes
+		totalCount += usage.count
+	}
+
+	var sorted []*projectCacheUsage
+	for _, usage := range projects {
+		sorted = append(sorted, usage)
+	}
+	share := func(usage *projectCacheUsage) float64 {
+		if totalBytes > 0 {
+			return float64(usage.bytes) * float64(len(projects)) / float64(totalBytes)
+		}
+		return float64(usage.count) * float64(len(projects)) / float64(totalCount)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return share(sorted[i]) > share(sorted[j])
+	})
+
+	for _, usage := range sorted {
+		if share(usage) <= 1 {
+			break
+		}
+		for _, cache := range usage.caches {
+			if cache.score() >= 0 && !removalBlocked(cache.ID) {
+				logrus.WithFields(cacheFields(cache)).Infoln("Project", usage.projectID,
+					"uses", humanize.Bytes(uint64(usage.bytes)), "in", usage.count, "caches, more than its share")
+				return cache.ID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// overQuotaCaches returns the caches to remove to bring every project
+// within its quota, only the caches past their TTL are returned
+func overQuotaCaches() (caches []CacheInfo) {
+	if len(cacheQuotas) == 0 {
+		return
+	}
+
+	var all []CacheInfo
+	for _, cache := range cachesUsed {
+		all = append(all, cache)
+	}
+
+	for projectID, usage := range cacheUsageByProject(all) {
+		quota, ok := cacheQuotaFor(projectID)
+		if !ok {
+			continue
+		}
+		for _, cache := range usage.caches {
+			if !quota.exceeded(*usage) || cache.score() < 0 {
+				break
+			}
+			if removalBlocked(cache.ID) {
+				continue
+			}
+			caches = append(caches, cache)
+			usage.bytes -= cache.size()
+			usage.count--
+		}
+	}
+	return
+}
+
+func enforceCacheQuotas(client DockerClient) error {
+	caches := overQuotaCaches()
+	if len(caches) == 0 {
+		return nil
+	}
+
+	diskSpace, err := client.DiskSpace(dockerContext, opts.MonitorPath)
+	if err != nil {
+		return err
+	}
+
+	var lastError error
+	for _, cache := range caches {
+		if !cycleBudget.allow() {
+			break
+		}
+		logrus.WithFields(cacheFields(cache)).Infoln("Project", cache.Name.ProjectID, "is over its cache quota")
+		lastError = removeCache(client, cache)
+		cycleBudget.spend(cache.size())
+
+		before := diskSpace
+		diskSpace, err = client.DiskSpace(dockerContext, opts.MonitorPath)
+		if err != nil {
+			return err
+		}
+		auditCacheRemoval(cache, "quota", &before, &diskSpace, lastError)
+		if lastError == nil {
+			delete(cachesUsed, cache.ID)
+		}
+	}
+	return lastError
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+func (s *CleanupSuite) TestParseCacheQuotas(c *C) {
+	quotas, err := parseCacheQuotas("")
+	c.Assert(err, IsNil)
+	c.Assert(quotas, IsNil)
+
+	quotas, err = parseCacheQuotas("42:10GB:20, *::5, 7:1MB:")
+	c.Assert(err, IsNil)
+	c.Assert(quotas, DeepEquals, map[int64]CacheQuota{
+		42:         {MaxBytes: 10 * humanize.GByte, MaxCount: 20},
+		anyProject: {MaxCount: 5},
+		7:          {MaxBytes: humanize.MByte},
+	})
+
+	for _, invalid := range []string{"42:10GB", "project:1GB:1", "1:lots:1", "1:1GB:many"} {
+		_, err = parseCacheQuotas(invalid)
+		c.Assert(err, NotNil, Commentf("%s", invalid))
+	}
+}
+
+func (s *CleanupSuite) TestCacheQuotaByCount(c *C) {
+	s.dockerClient.freeSpace = humanize.GByte
+	s.dockerClient.freeFiles = 100000
+	s.dockerClient.containers = []APIContainers{
+		makeDockerContainer(makeDockerCacheName(1, "1"), "cache"),
+		makeDockerContainer(makeDockerCacheName(1, "2"), "cache"),
+		makeDockerContainer(makeDockerCacheName(1, "3"), "cache"),
+		makeDockerContainer(makeDockerCacheName(2, "1"), "cache"),
+	}
+	cacheQuotas = map[int64]CacheQuota{
+		anyProject: {MaxCount: 1},
+	}
+
+	err := doCycle(s.dockerClient, humanize.MByte, humanize.GByte, 1000, 10000)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedContainers, HasLen, 2)
+	for _, id := range s.dockerClient.removedContainers {
+		c.Assert(cachesUsed[id].Name.ProjectID, Equals, int64(0))
+	}
+	c.Assert(cachesUsed, HasLen, 2)
+}
+
+func (s *CleanupSuite) TestCacheQuotaBySize(c *C) {
+	var volumes []Volume
+	for _, id := range []string{"1", "2"} {
+		dir := c.MkDir()
+		err := ioutil.WriteFile(filepath.Join(dir, "data"), make([]byte, 3*humanize.KByte), 0600)
+		c.Assert(err, IsNil)
+		volumes = append(volumes, Volume{Name: makeDockerCacheName(42, id), Mountpoint: dir})
+	}
+
+	s.dockerClient.freeSpace = humanize.GByte
+	s.dockerClient.freeFiles = 100000
+	s.dockerClient.volumes = volumes
+	cacheQuotas = map[int64]CacheQuota{
+		42: {MaxBytes: 4 * humanize.KByte},
+	}
+
+	err := doCycle(s.dockerClient, humanize.MByte, humanize.GByte, 1000, 10000)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedVolumes, HasLen, 1)
+
+	remaining := volumes[0].Name
+	if s.dockerClient.removedVolumes[0] == remaining {
+		remaining = volumes[1].Name
+	}
+	c.Assert(cachesUsed[remaining].Size, Equals, int64(3*humanize.KByte))
+}
+
+func (s *CleanupSuite) TestFairCacheEviction(c *C) {
+	s.dockerClient.freeSpace = humanize.GByte
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("old", 100*humanize.MByte),
+	}
+	s.dockerClient.containers = []APIContainers{
+		makeDockerContainerWithSize(makeDockerCacheName(1, "1"), "cache", 300*humanize.MByte),
+		makeDockerContainerWithSize(makeDockerCacheName(1, "2"), "cache", 300*humanize.MByte),
+		makeDockerContainerWithSize(makeDockerCacheName(2, "1"), "cache", 100*humanize.MByte),
+	}
+	opts.FairCacheEviction = true
+	defer func() { opts.FairCacheEviction = false }()
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	err = doFreeSpace(s.dockerClient, humanize.GByte+500*humanize.MByte, 100000)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, HasLen, 0)
+	c.Assert(s.dockerClient.removedContainers, HasLen, 2)
+	for _, id := range s.dockerClient.removedContainers {
+		c.Assert(cachesUsed[id].Name.ProjectID, Equals, int64(1))
+	}
+}
+
+func (s *CleanupSuite) TestCacheSizeIsMeasuredAgainOnlyAfterUse(c *C) {
+	opts.CacheMeasureInterval = time.Hour
+	dir := c.MkDir()
+	data := filepath.Join(dir, "data")
+	err := ioutil.WriteFile(data, make([]byte, 3*humanize.KByte), 0600)
+	c.Assert(err, IsNil)
+	name := makeDockerCacheName(42, "1")
+	s.dockerClient.volumes = []Volume{{Name: name, Mountpoint: dir}}
+	cacheQuotas = map[int64]CacheQuota{
+		42: {MaxBytes: humanize.GByte},
+	}
+
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(cachesUsed[name].Size, Equals, int64(3*humanize.KByte))
+
+	err = ioutil.WriteFile(data, make([]byte, 5*humanize.KByte), 0600)
+	c.Assert(err, IsNil)
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(cachesUsed[name].Size, Equals, int64(3*humanize.KByte))
+
+	cache := cachesUsed[name]
+	cache.Used = time.Now()
+	cachesUsed[name] = cache
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(cachesUsed[name].Size, Equals, int64(3*humanize.KByte))
+
+	cache = cachesUsed[name]
+	cache.Measured = time.Now().Add(-2 * time.Hour)
+	cachesUsed[name] = cache
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(cachesUsed[name].Size, Equals, int64(5*humanize.KByte))
+}
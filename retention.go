@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	retentionOrderUsed    = "used"
+	retentionOrderCreated = "created"
+	retentionOrderSemver  = "semver"
+)
+
+type TagRetention struct {
+	Pattern string
+	Keep    int
+	Order   string
+}
+
+var tagRetentions []TagRetention
+
+// parseTagRetentions parses the comma separated list of <repository pattern>=<keep>[:<order>]
+func parseTagRetentions(retentions string) ([]TagRetention, error) {
+	if retentions == "" {
+		return nil, nil
+	}
+
+	var result []TagRetention
+	for _, rule := range strings.Split(retentions, ",") {
+		rule = strings.TrimSpace(rule)
+		idx := strings.LastIndex(rule, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid tag retention %q, expected <repository pattern>=<keep>[:<order>]", rule)
+		}
+
+		retention := TagRetention{
+			Pattern: rule[:idx],
+			Order:   retentionOrderUsed,
+		}
+		if _, err := filepath.Match(retention.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern in tag retention %q: %v", rule, err)
+		}
+
+		parts := strings.SplitN(rule[idx+1:], ":", 2)
+		keep, err := strconv.Atoi(parts[0])
+		if err != nil || keep < 0 {
+			return nil, fmt.Errorf("invalid count in tag retention %q", rule)
+		}
+		retention.Keep = keep
+		if len(parts) == 2 {
+			switch parts[1] {
+			case retentionOrderUsed, retentionOrderCreated, retentionOrderSemver:
+				retention.Order = parts[1]
+			default:
+				return nil, fmt.Errorf("invalid order in tag retention %q, expected used, created or semver", rule)
+			}
+		}
+		result = append(result, retention)
+	}
+	return result, nil
+}
+
+func tagRetentionFor(repository string) (TagRetention, bool) {
+	for _, retention := range tagRetentions {
+		if matched, _ := filepath.Match(retention.Pattern, repository); matched {
+			return retention, true
+		}
+	}
+	return TagRetention{}, false
+}
+
+// parseVersion parses the tags like v1.2.3 or 1.2.3-rc1
+func parseVersion(tag string) (numbers []int64, prerelease string, ok bool) {
+	tag = strings.TrimPrefix(tag, "v")
+	if idx := strings.IndexAny(tag, "-+"); idx >= 0 {
+		if tag[idx] == '-' {
+			prerelease = tag[idx+1:]
+			if plus := strings.Index(prerelease, "+"); plus >= 0 {
+				prerelease = prerelease[:plus]
+			}
+		}
+		tag = tag[:idx]
+	}
+	for _, part := range strings.Split(tag, ".") {
+		number, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, "", false
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, prerelease, true
+}
+
+// newerVersion compares the tags as semantic versions,
+// the tags that are not versions are older than all versions
+func newerVersion(tag, otherTag string) bool {
+	numbers, prerelease, ok := parseVersion(tag)
+	otherNumbers, otherPrerelease, otherOk := parseVersion(otherTag)
+	if ok != otherOk {
+		return ok
+	}
+	if !ok {
+		return false
+	}
+
+	for i := 0; i < len(numbers) || i < len(otherNumbers); i++ {
+		var number, otherNumber int64
+		if i < len(numbers) {
+			number = numbers[i]
+		}
+		if i < len(otherNumbers) {
+			otherNumber = otherNumbers[i]
+		}
+		if number != otherNumber {
+			return number > otherNumber
+		}
+	}
+	if prerelease == "" || otherPrerelease == "" {
+		return prerelease == "" && otherPrerelease != ""
+	}
+	return prerelease > otherPrerelease
+}
+
+type retainedTag struct {
+	tag     string
+	name    string
+	image   ImageInfo
+	used    time.Time
+	created int64
+}
+
+func sortRetainedTags(tags []retainedTag, order string) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		switch order {
+		case retentionOrderCreated:
+			return tags[i].created > tags[j].created
+		case retentionOrderSemver:
+			if newerVersion(tags[i].name, tags[j].name) {
+				return true
+			}
+			if newerVersion(tags[j].name, tags[i].name) {
+				return false
+			}
+		}
+		return tags[i].used.After(tags[j].used)
+	})
+}
+
+// excessTags returns the tags of every image over the retention limit of their repository,
+// the tags still within their TTL are not returned
+func excessTags() map[string][]string {
+	repositories := make(map[string][]retainedTag)
+	for _, image := range imagesUsed {
+		for tag, tagTTL := range image.Tags {
+			repository, name := docker.ParseRepositoryTag(tag)
+			if _, ok := tagRetentionFor(repository); !ok {
+				continue
+			}
+			repositories[repository] = append(repositories[repository], retainedTag{
+				tag:     tag,
+				name:    name,
+				image:   image,
+				used:    tagTTL.Used,
+				created: image.Created,
+			})
+		}
+	}
+
+	excess := make(map[string][]string)
+	for repository, tags := range repositories {
+		retention, _ := tagRetentionFor(repository)
+		if len(tags) <= retention.Keep {
+			continue
+		}
+		sortRetainedTags(tags, retention.Order)
+		for _, tag := range tags[retention.Keep:] {
+			tagTTL := tag.image.Tags[tag.tag]
+			if tagTTL.score() < 0 {
+				continue
+			}
+			excess[tag.image.ID] = append(excess[tag.image.ID], tag.tag)
+		}
+	}
+	return excess
+}
+
+func enforceTagRetention(client DockerClient) error {
+	if len(tagRetentions) == 0 {
+		return nil
+	}
+
+	imageTags := excessTags()
+	if len(imageTags) == 0 {
+		return nil
+	}
+
+	diskSpace, err := client.DiskSpace(dockerContext, opts.MonitorPath)
+	if err != nil {
+		return err
+	}
+
+	var lastError error
+	for id, tags := range imageTags {
+		if !cycleBudget.allow() {
+			break
+		}
+		if removalBlocked(id) {
+			continue
+		}
+		imageInfo := imagesUsed[id]
+		internal := make(map[string]bool)
+		for _, tag := range internalTags(imageInfo.APIImages) {
+			internal[tag] = true
+		}
+		excess := make(map[string]bool)
+		var stale []string
+		for _, tag := range tags {
+			excess[tag] = true
+			if !internal[tag] {
+				stale = append(stale, tag)
+			}
+		}
+		if len(stale) == 0 {
+			continue
+		}
+
+		var retained []string
+		for tag := range imageInfo.Tags {
+			if !excess[tag] || internal[tag] {
+				retained = append(retained, tag)
+			}
+		}
+		sort.Strings(retained)
+
+		logrus.WithFields(imageFields(imageInfo.APIImages)).Infoln("Tags over the retention limit:", strings.Join(stale, ", "))
+		var removeErr error
+		untagged := len(retained) > 0
+		if untagged {
+			removeErr = untagImage(client, imageInfo.APIImages, retained, stale)
+		} else {
+			_, stale = imageInfo.retainedTags()
+			untagged, removeErr = removeImage(client, imageInfo.APIImages)
+		}
+		if untagged {
+			cycleBudget.spend(0)
+		} else {
+			cycleBudget.spend(imageInfo.Size)
+		}
+
+		before := diskSpace
+		diskSpace, err = client.DiskSpace(dockerContext, opts.MonitorPath)
+		if err != nil {
+			return err
+		}
+		if untagged {
+			auditImageUntag(imageInfo, stale, "retention", &before, &diskSpace, removeErr)
+		} else {
+			auditImageRemoval(imageInfo, "retention", &before, &diskSpace, removeErr)
+		}
+		if removeErr != nil {
+			lastError = removeErr
+		} else if !untagged {
+			delete(imagesUsed, id)
+		}
+	}
+	return lastError
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (s *CleanupSuite) TestParseTagRetentions(c *C) {
+	retentions, err := parseTagRetentions("app=3, registry.example.com:5000/group/*=5:semver")
+	c.Assert(err, IsNil)
+	c.Assert(retentions, DeepEquals, []TagRetention{
+		{Pattern: "app", Keep: 3, Order: retentionOrderUsed},
+		{Pattern: "registry.example.com:5000/group/*", Keep: 5, Order: retentionOrderSemver},
+	})
+
+	_, err = parseTagRetentions("app")
+	c.Assert(err, NotNil)
+	_, err = parseTagRetentions("app=x")
+	c.Assert(err, NotNil)
+	_, err = parseTagRetentions("app=1:size")
+	c.Assert(err, NotNil)
+}
+
+func (s *CleanupSuite) TestNewerVersion(c *C) {
+	c.Assert(newerVersion("1.10.0", "1.9.2"), Equals, true)
+	c.Assert(newerVersion("v2.0", "1.99.99"), Equals, true)
+	c.Assert(newerVersion("1.0.0", "1.0.0-rc1"), Equals, true)
+	c.Assert(newerVersion("1.0.0-rc2", "1.0.0-rc1"), Equals, true)
+	c.Assert(newerVersion("0.1", "latest"), Equals, true)
+	c.Assert(newerVersion("latest", "0.1"), Equals, false)
+	c.Assert(newerVersion("1.0", "1.0.0"), Equals, false)
+}
+
+func (s *CleanupSuite) setUpRetentionImages(c *C, tags ...string) {
+	s.dockerClient.images = nil
+	for idx, tag := range tags {
+		image := makeDockerImage(tag)
+		image.Created = int64(idx)
+		s.dockerClient.images = append(s.dockerClient.images, image)
+	}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	for idx, tag := range tags {
+		imagesUsed[tag].Tags[tag] = ObjectTTL{
+			Used: time.Now().Add(-time.Duration(idx) * time.Minute),
+			TTL:  time.Now().Add(-time.Minute),
+		}
+	}
+}
+
+func (s *CleanupSuite) TestTagRetentionKeepsRecentlyUsedTags(c *C) {
+	tagRetentions, _ = parseTagRetentions("app=2")
+	s.setUpRetentionImages(c, "app:a", "app:b", "app:c", "other:d")
+
+	err := enforceTagRetention(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"app:c"})
+	c.Assert(imagesUsed, HasLen, 3)
+}
+
+func (s *CleanupSuite) TestTagRetentionByCreation(c *C) {
+	tagRetentions, _ = parseTagRetentions("app=1:created")
+	s.setUpRetentionImages(c, "app:a", "app:b")
+
+	err := enforceTagRetention(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"app:a"})
+}
+
+func (s *CleanupSuite) TestTagRetentionBySemver(c *C) {
+	tagRetentions, _ = parseTagRetentions("app=1:semver")
+	s.setUpRetentionImages(c, "app:1.9.0", "app:1.10.0")
+
+	err := enforceTagRetention(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"app:1.9.0"})
+}
+
+func (s *CleanupSuite) TestTagRetentionUntagsSharedImages(c *C) {
+	tagRetentions, _ = parseTagRetentions("app=1")
+	s.dockerClient.images = []APIImages{
+		makeDockerMultiTagImage("image", "app:a", "app:b"),
+	}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	imagesUsed["image"].Tags["app:a"] = ObjectTTL{Used: time.Now(), TTL: time.Now().Add(-time.Second)}
+	imagesUsed["image"].Tags["app:b"] = ObjectTTL{Used: time.Now().Add(-time.Hour), TTL: time.Now().Add(-time.Second)}
+
+	err = enforceTagRetention(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"app:b"})
+}
+
+func (s *CleanupSuite) TestTagRetentionWaitsForTTL(c *C) {
+	tagRetentions, _ = parseTagRetentions("app=0")
+	opts.DefaultTTL = time.Hour
+	s.dockerClient.images = []APIImages{makeDockerImage("app:a")}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	err = enforceTagRetention(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, HasLen, 0)
+}
+
+func (s *CleanupSuite) TestTagRetentionAuditsDiskSpace(c *C) {
+	path := s.openTestAuditLog(c, 0, 0)
+	tagRetentions, _ = parseTagRetentions("app=1")
+	s.setUpRetentionImages(c, "app:1", "app:2")
+
+	err := enforceTagRetention(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	records := readAuditRecords(c, path)
+	c.Assert(records, HasLen, 1)
+	for _, record := range records {
+		c.Assert(record.Reason, Equals, "retention")
+		c.Assert(record.DiskBefore, NotNil)
+		c.Assert(record.DiskAfter, NotNil)
+	}
+}
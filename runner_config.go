@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"time"
+)
+
+const runnerTokenPrefix = "glrt-"
+
+type RunnerDockerConfig struct {
+	Host        string `toml:"host"`
+	TLSCertPath string `toml:"tls_cert_path"`
+	TLSVerify   bool   `toml:"tls_verify"`
+	Image       string `toml:"image"`
+	HelperImage string `toml:"helper_image"`
+}
+
+type RunnerConfigRunner struct {
+	Name     string              `toml:"name"`
+	Token    string              `toml:"token"`
+	Executor string              `toml:"executor"`
+	Docker   *RunnerDockerConfig `toml:"docker"`
+}
+
+type RunnerConfig struct {
+	Concurrent int                  `toml:"concurrent"`
+	Runners    []RunnerConfigRunner `toml:"runners"`
+
+	modTime time.Time
+}
+
+var runnerConfig *RunnerConfig
+
+func loadRunnerConfig(path string) (*RunnerConfig, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &RunnerConfig{
+		modTime: stat.ModTime(),
+	}
+	_, err = toml.DecodeFile(path, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func reloadRunnerConfig(path string) {
+	if path == "" {
+		return
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		logrus.Warningln("Failed to read runner config:", err)
+		return
+	}
+	if runnerConfig != nil && stat.ModTime().Equal(runnerConfig.modTime) {
+		return
+	}
+
+	config, err := loadRunnerConfig(path)
+	if err != nil {
+		logrus.Warningln("Failed to load runner config:", err)
+		return
+	}
+	runnerConfig = config
+	logrus.WithFields(logrus.Fields{
+		"runners":    len(config.Runners),
+		"concurrent": config.Concurrent,
+		"images":     config.protectedImages(),
+	}).Infoln("Loaded runner config", path)
+}
+
+func shortenRunnerToken(token string) string {
+	if strings.HasPrefix(token, runnerTokenPrefix) && len(token) >= len(runnerTokenPrefix)+9 {
+		return token[len(runnerTokenPrefix) : len(runnerTokenPrefix)+9]
+	}
+	if len(token) < 8 {
+		return token
+	}
+	return token[:8]
+}
+
+func normalizeImageName(image string) string {
+	if strings.Contains(image, "@") {
+		return image
+	}
+	if strings.LastIndex(image, ":") <= strings.LastIndex(image, "/") {
+		return image + ":latest"
+	}
+	return image
+}
+
+func (c *RunnerConfig) protectedImages() (images []string) {
+	if c == nil {
+		return
+	}
+	for _, runner := range c.Runners {
+		if runner.Docker == nil {
+			continue
+		}
+		if runner.Docker.Image != "" {
+			images = append(images, normalizeImageName(runner.Docker.Image))
+		}
+		if runner.Docker.HelperImage != "" {
+			images = append(images, normalizeImageName(runner.Docker.HelperImage))
+		}
+	}
+	return
+}
+
+func (c *RunnerConfig) tokens() (tokens []string) {
+	if c == nil {
+		return
+	}
+	for _, runner := range c.Runners {
+		if runner.Token != "" {
+			tokens = append(tokens, shortenRunnerToken(runner.Token))
+		}
+	}
+	return
+}
+
+func (c *RunnerConfig) ownsCache(name string) bool {
+	tokens := c.tokens()
+	if len(tokens) == 0 {
+		return true
+	}
+	for _, token := range tokens {
+		if strings.Contains(name, "runner-"+token+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *RunnerConfig) dockerConfig() *RunnerDockerConfig {
+	if c == nil {
+		return nil
+	}
+
+	var found *RunnerDockerConfig
+	for _, runner := range c.Runners {
+		if runner.Docker == nil || runner.Docker.Host == "" {
+			continue
+		}
+		if found == nil {
+			found = runner.Docker
+		} else if found.Host != runner.Docker.Host {
+			logrus.Warningln("Runner", runner.Name, "uses a different docker host", runner.Docker.Host,
+				"only", found.Host, "will be cleaned up")
+		}
+	}
+	return found
+}
+
+func (c *RunnerConfig) expectedFreeSpace(expectedFreeSpace, freeSpacePerJob uint64) uint64 {
+	if c == nil || freeSpacePerJob == 0 {
+		return expectedFreeSpace
+	}
+	concurrent := c.Concurrent
+	if previous, ok := concurrentBeforePause(); ok {
+		concurrent = previous
+	}
+	if perJobs := uint64(concurrent) * freeSpacePerJob; perJobs > expectedFreeSpace {
+		return perJobs
+	}
+	return expectedFreeSpace
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const testRunnerConfigWithDocker = `concurrent = 4
+
+[[runners]]
+  name = "first"
+  token = "abcdefgh12345"
+  executor = "docker"
+  [runners.docker]
+    host = "tcp://docker:2375"
+    image = "ruby:2.1"
+    helper_image = "registry.example.com/helper:x86_64-latest"
+
+[[runners]]
+  name = "second"
+  token = "glrt-123456789abcdef"
+  executor = "docker"
+  [runners.docker]
+    image = "alpine"
+`
+
+func (s *CleanupSuite) TestLoadRunnerConfig(c *C) {
+	path := s.writeTestRunnerConfig(c, testRunnerConfigWithDocker)
+
+	reloadRunnerConfig(path)
+	c.Assert(runnerConfig, NotNil)
+	c.Assert(runnerConfig.Concurrent, Equals, 4)
+	c.Assert(runnerConfig.protectedImages(), DeepEquals, []string{
+		"ruby:2.1",
+		"registry.example.com/helper:x86_64-latest",
+		"alpine:latest",
+	})
+	c.Assert(runnerConfig.tokens(), DeepEquals, []string{"abcdefgh", "123456789"})
+	c.Assert(runnerConfig.dockerConfig().Host, Equals, "tcp://docker:2375")
+}
+
+func (s *CleanupSuite) TestRunnerConfigReload(c *C) {
+	path := s.writeTestRunnerConfig(c, testRunnerConfigWithDocker)
+	reloadRunnerConfig(path)
+	c.Assert(runnerConfig.Concurrent, Equals, 4)
+
+	err := ioutil.WriteFile(path, []byte("concurrent = 8\n"), 0600)
+	c.Assert(err, IsNil)
+	modTime := time.Now().Add(time.Minute)
+	err = os.Chtimes(path, modTime, modTime)
+	c.Assert(err, IsNil)
+
+	reloadRunnerConfig(path)
+	c.Assert(runnerConfig.Concurrent, Equals, 8)
+	c.Assert(runnerConfig.protectedImages(), HasLen, 0)
+
+	err = ioutil.WriteFile(path, []byte("concurrent = \n"), 0600)
+	c.Assert(err, IsNil)
+	modTime = modTime.Add(time.Minute)
+	err = os.Chtimes(path, modTime, modTime)
+	c.Assert(err, IsNil)
+
+	reloadRunnerConfig(path)
+	c.Assert(runnerConfig.Concurrent, Equals, 8)
+}
+
+func (s *CleanupSuite) TestRunnerConfigProtectsImagesAndCaches(c *C) {
+	path := s.writeTestRunnerConfig(c, testRunnerConfigWithDocker)
+	reloadRunnerConfig(path)
+
+	c.Assert(isInternalImage(makeDockerImage("ruby:2.1")), Equals, true)
+	c.Assert(isInternalImage(makeDockerImage("alpine:latest")), Equals, true)
+	c.Assert(isInternalImage(makeDockerImage("alpine:3.7")), Equals, false)
+
+	c.Assert(isCacheContainer("/runner-abcdefgh-project-1-concurrent-0-cache-3c3f060a0374fc8bc39395164f415a70"), Equals, true)
+	c.Assert(isCacheContainer("/runner-123456789-project-1-concurrent-0-cache-3c3f060a0374fc8bc39395164f415a70"), Equals, true)
+	c.Assert(isCacheContainer("/runner-othertkn-project-1-concurrent-0-cache-3c3f060a0374fc8bc39395164f415a70"), Equals, false)
+}
+
+func (s *CleanupSuite) TestRunnerConfigExpectedFreeSpace(c *C) {
+	var config *RunnerConfig
+	c.Assert(config.expectedFreeSpace(humanize.GByte, humanize.GByte), Equals, uint64(humanize.GByte))
+
+	config = &RunnerConfig{Concurrent: 4}
+	c.Assert(config.expectedFreeSpace(humanize.GByte, 0), Equals, uint64(humanize.GByte))
+	c.Assert(config.expectedFreeSpace(humanize.GByte, humanize.GByte), Equals, uint64(4*humanize.GByte))
+	c.Assert(config.expectedFreeSpace(10*humanize.GByte, humanize.GByte), Equals, uint64(10*humanize.GByte))
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const gitlabAPITimeout = 30 * time.Second
+
+var concurrentRegexp = regexp.MustCompile(`(?m)^(concurrent\s*=\s*)(\d+)`)
+
+type RunnerPauser interface {
+	Pause() error
+	Resume() error
+}
+
+var runnerPauser RunnerPauser
+var runnerPaused bool
+
+type apiRunnerPauser struct {
+	url       string
+	token     string
+	runnerIDs []string
+	client    *http.Client
+}
+
+func newAPIRunnerPauser(baseURL, token, runnerIDs string) (*apiRunnerPauser, error) {
+	if baseURL == "" || token == "" || runnerIDs == "" {
+		return nil, errors.New("pausing the runner through the API requires the GitLab URL, token and runner IDs")
+	}
+
+	p := &apiRunnerPauser{
+		url:   strings.TrimRight(baseURL, "/"),
+		token: token,
+		client: &http.Client{
+			Timeout: gitlabAPITimeout,
+		},
+	}
+	for _, id := range strings.Split(runnerIDs, ",") {
+		p.runnerIDs = append(p.runnerIDs, strings.TrimSpace(id))
+	}
+	return p, nil
+}
+
+func (p *apiRunnerPauser) setPaused(paused bool) error {
+	form := url.Values{}
+	form.Set("paused", strconv.FormatBool(paused))
+
+	for _, id := range p.runnerIDs {
+		req, err := http.NewRequest("PUT", p.url+"/api/v4/runners/"+url.PathEscape(id), strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("PRIVATE-TOKEN", p.token)
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("failed to update runner %s: %s", id, resp.Status)
+		}
+	}
+	return nil
+}
+
+func (p *apiRunnerPauser) Pause() error {
+	return p.setPaused(true)
+}
+
+func (p *apiRunnerPauser) Resume() error {
+	return p.setPaused(false)
+}
+
+type configRunnerPauser struct {
+	path       string
+	concurrent int
+	previous   string
+}
+
+func newConfigRunnerPauser(path string, concurrent int) (*configRunnerPauser, error) {
+	if path == "" {
+		return nil, errors.New("pausing the runner through config.toml requires the runner config path")
+	}
+	p := &configRunnerPauser{
+		path:       path,
+		concurrent: concurrent,
+	}
+
+	// the runner paused by the previous run keeps its concurrent setting next to config.toml
+	data, err := ioutil.ReadFile(p.pausedPath())
+	if err == nil {
+		p.previous = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *configRunnerPauser) pausedPath() string {
+	return p.path + ".paused"
+}
+
+func writeFileAtomically(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	stat, err := os.Stat(path)
+	if err == nil {
+		mode = stat.Mode()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(file.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (p *configRunnerPauser) readConcurrent() (data []byte, match []int, err error) {
+	data, err = ioutil.ReadFile(p.path)
+	if err != nil {
+		return
+	}
+
+	match = concurrentRegexp.FindSubmatchIndex(data)
+	if match == nil {
+		err = fmt.Errorf("no global concurrent setting in %s", p.path)
+	}
+	return
+}
+
+func (p *configRunnerPauser) setConcurrent(value string) (previous string, err error) {
+	data, match, err := p.readConcurrent()
+	if err != nil {
+		return
+	}
+	previous = string(data[match[4]:match[5]])
+
+	updated := make([]byte, 0, len(data))
+	updated = append(updated, data[:match[4]]...)
+	updated = append(updated, value...)
+	updated = append(updated, data[match[5]:]...)
+	err = writeFileAtomically(p.path, updated)
+	return
+}
+
+func (p *configRunnerPauser) Pause() error {
+	data, match, err := p.readConcurrent()
+	if err != nil {
+		return err
+	}
+	previous := string(data[match[4]:match[5]])
+
+	// the previous setting is saved first, so it isn't lost when the tool restarts
+	err = writeFileAtomically(p.pausedPath(), []byte(previous+"\n"))
+	if err != nil {
+		return err
+	}
+	_, err = p.setConcurrent(strconv.Itoa(p.concurrent))
+	if err != nil {
+		os.Remove(p.pausedPath())
+		return err
+	}
+	p.previous = previous
+	return nil
+}
+
+func (p *configRunnerPauser) Resume() error {
+	if p.previous == "" {
+		return errors.New("the previous concurrent setting is unknown")
+	}
+	_, err := p.setConcurrent(p.previous)
+	if err != nil {
+		return err
+	}
+	p.previous = ""
+	return os.Remove(p.pausedPath())
+}
+
+func newRunnerPauser(mode string) (RunnerPauser, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "api":
+		return newAPIRunnerPauser(opts.GitLabURL, opts.GitLabToken, opts.RunnerIDs)
+	case "config":
+		return newConfigRunnerPauser(opts.RunnerConfigFile, opts.PausedConcurrent)
+	default:
+		return nil, fmt.Errorf("unknown pause runner mode: %q", mode)
+	}
+}
+
+// concurrentBeforePause returns the concurrent setting the runner is resumed with,
+// config.toml holds the paused one while the runner is paused through it
+func concurrentBeforePause() (int, bool) {
+	p, ok := runnerPauser.(*configRunnerPauser)
+	if !ok || !runnerPaused || p.previous == "" {
+		return 0, false
+	}
+	concurrent, err := strconv.Atoi(p.previous)
+	return concurrent, err == nil
+}
+
+// restoreRunnerPaused picks up the pause left by the previous run,
+// so the runner is resumed once the free space is back
+func restoreRunnerPaused() {
+	// config.toml can only be restored when the previous setting was saved
+	if p, ok := runnerPauser.(*configRunnerPauser); ok {
+		runnerPaused = p.previous != ""
+	}
+	if runnerPauser == nil {
+		runnerPaused = false
+	} else if runnerPaused {
+		logrus.Warningln("The runner was paused before the restart, it's resumed once the free space is back")
+	}
+}
+
+func pauseRunner(diskSpace DiskSpace) {
+	if runnerPauser == nil || runnerPaused {
+		return
+	}
+
+	err := runnerPauser.Pause()
+	if err != nil {
+		logrus.Warningln("Failed to pause the runner:", err)
+		return
+	}
+	runnerPaused = true
+	logrus.Warningln("Paused the runner, the free disk space", humanize.Bytes(diskSpace.BytesFree), "can't be recovered")
+}
+
+func resumeRunner(diskSpace DiskSpace, freeSpace uint64) {
+	if runnerPauser == nil || !runnerPaused || diskSpace.BytesFree < freeSpace {
+		return
+	}
+
+	err := runnerPauser.Resume()
+	if err != nil {
+		logrus.Warningln("Failed to resume the runner:", err)
+		return
+	}
+	runnerPaused = false
+	logrus.Infoln("Resumed the runner, the free disk space is back at", humanize.Bytes(diskSpace.BytesFree))
+}
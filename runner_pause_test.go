@@ -0,0 +1,165 @@
+package main
+
+import (
+	"github.com/dustin/go-humanize"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+type fakeRunnerPauser struct {
+	paused  int
+	resumed int
+}
+
+func (p *fakeRunnerPauser) Pause() error {
+	p.paused++
+	return nil
+}
+
+func (p *fakeRunnerPauser) Resume() error {
+	p.resumed++
+	return nil
+}
+
+const testRunnerConfig = `concurrent = 4
+check_interval = 0
+
+[[runners]]
+  name = "runner"
+  limit = 2
+`
+
+func (s *CleanupSuite) writeTestRunnerConfig(c *C, data string) string {
+	path := filepath.Join(c.MkDir(), "config.toml")
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	c.Assert(err, IsNil)
+	return path
+}
+
+func (s *CleanupSuite) TestConfigRunnerPauser(c *C) {
+	path := s.writeTestRunnerConfig(c, testRunnerConfig)
+
+	p, err := newConfigRunnerPauser(path, 1)
+	c.Assert(err, IsNil)
+
+	err = p.Pause()
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, "(?s)concurrent = 1\ncheck_interval = 0\n.*limit = 2\n")
+
+	err = p.Resume()
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, testRunnerConfig)
+
+	err = p.Resume()
+	c.Assert(err, NotNil)
+}
+
+func (s *CleanupSuite) TestAPIRunnerPauser(c *C) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "PUT")
+		c.Check(r.Header.Get("PRIVATE-TOKEN"), Equals, "token")
+		c.Check(r.ParseForm(), IsNil)
+		requests = append(requests, r.URL.Path+"?paused="+r.PostForm.Get("paused"))
+	}))
+	defer server.Close()
+
+	p, err := newAPIRunnerPauser(server.URL+"/", "token", "1, 2")
+	c.Assert(err, IsNil)
+
+	c.Assert(p.Pause(), IsNil)
+	c.Assert(p.Resume(), IsNil)
+	c.Assert(requests, DeepEquals, []string{
+		"/api/v4/runners/1?paused=true",
+		"/api/v4/runners/2?paused=true",
+		"/api/v4/runners/1?paused=false",
+		"/api/v4/runners/2?paused=false",
+	})
+
+	_, err = newAPIRunnerPauser(server.URL, "", "1")
+	c.Assert(err, NotNil)
+}
+
+func (s *CleanupSuite) TestCyclePausesAndResumesRunner(c *C) {
+	pauser := &fakeRunnerPauser{}
+	runnerPauser = pauser
+
+	s.dockerClient.freeSpace = humanize.KByte
+	err := doCycle(s.dockerClient, humanize.MByte, humanize.GByte, 1000, 10000)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(pauser.paused, Equals, 1)
+	c.Assert(runnerPaused, Equals, true)
+
+	err = doCycle(s.dockerClient, humanize.MByte, humanize.GByte, 1000, 10000)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(pauser.paused, Equals, 1)
+
+	s.dockerClient.freeSpace = humanize.MByte * 10
+	s.dockerClient.freeFiles = 100000
+	err = doCycle(s.dockerClient, humanize.MByte, humanize.GByte, 1000, 10000)
+	c.Assert(err, IsNil)
+	c.Assert(pauser.resumed, Equals, 0)
+
+	s.dockerClient.freeSpace = humanize.GByte
+	err = doCycle(s.dockerClient, humanize.MByte, humanize.GByte, 1000, 10000)
+	c.Assert(err, IsNil)
+	c.Assert(pauser.resumed, Equals, 1)
+	c.Assert(runnerPaused, Equals, false)
+}
+
+func (s *CleanupSuite) TestConfigRunnerPauserSurvivesRestart(c *C) {
+	path := s.writeTestRunnerConfig(c, testRunnerConfig)
+
+	p, err := newConfigRunnerPauser(path, 1)
+	c.Assert(err, IsNil)
+	c.Assert(p.Pause(), IsNil)
+
+	runnerPauser, err = newConfigRunnerPauser(path, 1)
+	c.Assert(err, IsNil)
+	restoreRunnerPaused()
+	c.Assert(runnerPaused, Equals, true)
+
+	resumeRunner(DiskSpace{BytesFree: humanize.GByte}, humanize.MByte)
+	c.Assert(runnerPaused, Equals, false)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, testRunnerConfig)
+	_, err = os.Stat(path + ".paused")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *CleanupSuite) TestAPIRunnerPausedSurvivesRestart(c *C) {
+	path := filepath.Join(c.MkDir(), "state.json")
+	runnerPauser = &fakeRunnerPauser{}
+	pauseRunner(DiskSpace{})
+	saveState(path)
+
+	runnerPaused = false
+	c.Assert(loadState(path), IsNil)
+	restoreRunnerPaused()
+	c.Assert(runnerPaused, Equals, true)
+}
+
+func (s *CleanupSuite) TestPausedRunnerExpectedFreeSpace(c *C) {
+	path := s.writeTestRunnerConfig(c, testRunnerConfig)
+	p, err := newConfigRunnerPauser(path, 1)
+	c.Assert(err, IsNil)
+	runnerPauser = p
+	pauseRunner(DiskSpace{})
+	c.Assert(runnerPaused, Equals, true)
+
+	reloadRunnerConfig(path)
+	c.Assert(runnerConfig.Concurrent, Equals, 1)
+	c.Assert(runnerConfig.expectedFreeSpace(humanize.GByte, humanize.GByte), Equals, uint64(4*humanize.GByte))
+
+	resumeRunner(DiskSpace{BytesFree: 2 * humanize.GByte}, runnerConfig.expectedFreeSpace(humanize.GByte, humanize.GByte))
+	c.Assert(runnerPaused, Equals, true)
+}
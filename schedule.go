@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cronField struct {
+	min, max int
+}
+
+var cronFields = []cronField{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, 0 and 7 are sunday
+}
+
+// CronSchedule is a standard 5 field cron expression:
+// minute, hour, day of month, month and day of week
+type CronSchedule struct {
+	fields [5]uint64
+	// as in cron, when both days are restricted either of them matches
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+func parseCronValue(value string, field cronField) (int, error) {
+	number, err := strconv.Atoi(value)
+	if err != nil || number < field.min || number > field.max {
+		return 0, fmt.Errorf("invalid value %q, expected %d-%d", value, field.min, field.max)
+	}
+	return number, nil
+}
+
+func parseCronField(expr string, field cronField) (bits uint64, err error) {
+	for _, part := range strings.Split(expr, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:idx]
+		}
+
+		from, to := field.min, field.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			from, err = parseCronValue(bounds[0], field)
+			if err != nil {
+				return 0, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = parseCronValue(bounds[1], field)
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				to = field.max
+			}
+			if from > to {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		}
+
+		for value := from; value <= to; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronSchedule(expr string) (*CronSchedule, error) {
+	if expr == "" {
+		return nil, nil
+	}
+
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q, expected 5 fields: minute hour day-of-month month day-of-week", expr)
+	}
+
+	schedule := &CronSchedule{
+		anyDayOfMonth: parts[2] == "*",
+		anyDayOfWeek:  parts[4] == "*",
+	}
+	for idx, part := range parts {
+		bits, err := parseCronField(part, cronFields[idx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", expr, err)
+		}
+		schedule.fields[idx] = bits
+	}
+	// sunday can be written as 7
+	if schedule.fields[4]&(1<<7) != 0 {
+		schedule.fields[4] |= 1
+	}
+	return schedule, nil
+}
+
+func (s *CronSchedule) matches(t time.Time) bool {
+	if s == nil {
+		return false
+	}
+
+	has := func(field, value int) bool {
+		return s.fields[field]&(1<<uint(value)) != 0
+	}
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+
+	dayOfMonth := has(2, t.Day())
+	dayOfWeek := has(4, int(t.Weekday()))
+	if s.anyDayOfMonth || s.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// matchesSince returns true when the schedule matched any minute after since and up to now,
+// so a run isn't missed when the checks are less frequent than every minute
+func (s *CronSchedule) matchesSince(since, now time.Time) bool {
+	if s == nil {
+		return false
+	}
+
+	now = now.Truncate(time.Minute)
+	if since.IsZero() || now.Sub(since) > 24*time.Hour {
+		since = now.Add(-time.Minute)
+	}
+	for t := since.Truncate(time.Minute).Add(time.Minute); !t.After(now); t = t.Add(time.Minute) {
+		if s.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+var deepCleanSchedule *CronSchedule
+var deepCleanFreeSpace uint64
+var quietHours *CronSchedule
+var criticalFreeSpace uint64
+var lastScheduleCheck time.Time
+var deepCleanPending bool
+
+func isQuietHours(now time.Time) bool {
+	return quietHours.matches(now)
+}
+
+// deepCleanDue returns true once for every time the deep clean schedule matches,
+// the deep clean stays pending until it can run
+func deepCleanDue(now time.Time) bool {
+	if deepCleanSchedule.matchesSince(lastScheduleCheck, now) {
+		deepCleanPending = true
+	}
+	lastScheduleCheck = now
+	return deepCleanPending
+}
+
+func deepCleanTarget(freeSpace uint64) uint64 {
+	if deepCleanFreeSpace > freeSpace {
+		return deepCleanFreeSpace
+	}
+	return freeSpace
+}
+
+// criticalBounds returns the bounds below which the cleanup runs during the quiet hours
+func criticalBounds(lowFreeSpace, lowFreeFiles uint64) (uint64, uint64) {
+	if criticalFreeSpace > 0 {
+		return criticalFreeSpace, lowFreeFiles / 2
+	}
+	return lowFreeSpace / 2, lowFreeFiles / 2
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (s *CleanupSuite) TestParseCronSchedule(c *C) {
+	schedule, err := parseCronSchedule("0 3 * * *")
+	c.Assert(err, IsNil)
+	c.Assert(schedule.matches(time.Date(2018, 5, 2, 3, 0, 0, 0, time.Local)), Equals, true)
+	c.Assert(schedule.matches(time.Date(2018, 5, 2, 3, 1, 0, 0, time.Local)), Equals, false)
+
+	schedule, err = parseCronSchedule("*/15 8-18 * * 1-5")
+	c.Assert(err, IsNil)
+	// 2018-05-02 is a wednesday
+	c.Assert(schedule.matches(time.Date(2018, 5, 2, 9, 30, 0, 0, time.Local)), Equals, true)
+	c.Assert(schedule.matches(time.Date(2018, 5, 2, 9, 31, 0, 0, time.Local)), Equals, false)
+	c.Assert(schedule.matches(time.Date(2018, 5, 6, 9, 30, 0, 0, time.Local)), Equals, false)
+
+	schedule, err = parseCronSchedule("0 0 1 * 7")
+	c.Assert(err, IsNil)
+	c.Assert(schedule.matches(time.Date(2018, 5, 1, 0, 0, 0, 0, time.Local)), Equals, true)
+	c.Assert(schedule.matches(time.Date(2018, 5, 6, 0, 0, 0, 0, time.Local)), Equals, true)
+	c.Assert(schedule.matches(time.Date(2018, 5, 7, 0, 0, 0, 0, time.Local)), Equals, false)
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		_, err = parseCronSchedule(expr)
+		c.Assert(err, NotNil, Commentf("%s", expr))
+	}
+
+	schedule, err = parseCronSchedule("")
+	c.Assert(err, IsNil)
+	c.Assert(schedule.matches(time.Now()), Equals, false)
+}
+
+func (s *CleanupSuite) TestCronScheduleMatchesSince(c *C) {
+	schedule, err := parseCronSchedule("0 3 * * *")
+	c.Assert(err, IsNil)
+
+	since := time.Date(2018, 5, 2, 2, 58, 30, 0, time.Local)
+	c.Assert(schedule.matchesSince(since, since.Add(2*time.Minute)), Equals, true)
+	c.Assert(schedule.matchesSince(since.Add(2*time.Minute), since.Add(3*time.Minute)), Equals, false)
+}
+
+func (s *CleanupSuite) TestQuietHoursOnlyAllowCriticalCleanup(c *C) {
+	quietHours, _ = parseCronSchedule("* * * * *")
+	s.dockerClient.images = []APIImages{makeDockerImageWithSize("test", 1000)}
+	s.dockerClient.freeSpace = 600
+	s.dockerClient.freeFiles = 1000
+
+	err := doCycle(s.dockerClient, 1000, 2000, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, HasLen, 0)
+
+	s.dockerClient.freeSpace = 400
+	err = doCycle(s.dockerClient, 1000, 2000, 0, 0)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"test"})
+}
+
+func (s *CleanupSuite) TestScheduledDeepClean(c *C) {
+	deepCleanSchedule, _ = parseCronSchedule("* * * * *")
+	deepCleanFreeSpace = 3000
+	s.dockerClient.images = []APIImages{makeDockerImageWithSize("test", 1000)}
+	s.dockerClient.freeSpace = 2500
+	s.dockerClient.freeFiles = 1000
+
+	err := doCycle(s.dockerClient, 1000, 2000, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, DeepEquals, []string{"test"})
+}
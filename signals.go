@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var shutdownRequested = make(chan struct{})
+var shutdownOnce sync.Once
+var reloadRequests = make(chan struct{}, 1)
+var dumpRequests = make(chan struct{}, 1)
+
+func isShuttingDown() bool {
+	select {
+	case <-shutdownRequested:
+		return true
+	default:
+		return false
+	}
+}
+
+func requestShutdown() {
+	shutdownOnce.Do(func() {
+		close(shutdownRequested)
+	})
+}
+
+func request(requests chan struct{}) {
+	select {
+	case requests <- struct{}{}:
+	default:
+	}
+}
+
+// handleSignals stops the cleanup after the current removal on the first SIGINT or SIGTERM
+// and cancels the Docker calls in flight on the second one. The reloads and the dumps
+// are handled by the main loop while it sleeps, so they never run during a check.
+func handleSignals() {
+	ctx, cancel := context.WithCancel(context.Background())
+	dockerContext = ctx
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGHUP:
+				request(reloadRequests)
+			case syscall.SIGUSR1:
+				request(dumpRequests)
+			default:
+				if isShuttingDown() {
+					logrus.Warningln("Received", sig, "again, cancelling the Docker calls in flight")
+					cancel()
+				} else {
+					logrus.Infoln("Received", sig, "stopping after the current removal")
+					requestShutdown()
+				}
+			}
+		}
+	}()
+}
+
+// sleep waits for the duration while handling the reloads and the dumps,
+// it returns false when the tool is shutting down
+func sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-shutdownRequested:
+			return false
+		case <-reloadRequests:
+			reloadConfig()
+		case <-dumpRequests:
+			dumpState()
+		}
+	}
+}
+
+// reloadConfig reloads the runner config.toml and the additional internal images right away
+func reloadConfig() {
+	logrus.Infoln("Reloading the configuration")
+	if runnerConfig != nil {
+		runnerConfig.modTime = time.Time{}
+	}
+	reloadRunnerConfig(opts.RunnerConfigFile)
+
+	loadInternalImages()
+	logrus.WithField("images", internalImages).Infoln("Loaded", len(internalImages), "internal images")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (s *CleanupSuite) TestShutdownStopsRemovals(c *C) {
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("image1", 100),
+		makeDockerImageWithSize("image2", 100),
+	}
+	s.dockerClient.freeFiles = 1000
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	requestShutdown()
+	requestShutdown()
+	c.Assert(isShuttingDown(), Equals, true)
+
+	err = doFreeSpace(s.dockerClient, 1000, 0)
+	c.Assert(err, Equals, errBudgetExhausted)
+	c.Assert(s.dockerClient.removedImages, HasLen, 0)
+	c.Assert(sleep(time.Minute), Equals, false)
+}
+
+func (s *CleanupSuite) TestSleepHandlesRequests(c *C) {
+	request(dumpRequests)
+	request(dumpRequests)
+	request(reloadRequests)
+
+	c.Assert(sleep(10*time.Millisecond), Equals, true)
+	c.Assert(dumpRequests, HasLen, 0)
+	c.Assert(reloadRequests, HasLen, 0)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// PersistedState keeps the usage of the images and the caches across restarts
+type PersistedState struct {
+	Time      time.Time                     `json:"time"`
+	Images    map[string]ImageInfo          `json:"images"`
+	Caches    map[string]CacheInfo          `json:"caches"`
+	Histories map[string]*ImageUsageHistory `json:"histories"`
+	Removals  int64                         `json:"image_removals"`
+	Thrashes  int64                         `json:"image_thrashes"`
+	Paused    bool                          `json:"runner_paused"`
+}
+
+func saveState(path string) {
+	if path == "" {
+		return
+	}
+
+	state := PersistedState{
+		Time:      time.Now(),
+		Images:    imagesUsed,
+		Caches:    cachesUsed,
+		Histories: imageHistories,
+		Removals:  imageRemovals,
+		Thrashes:  imageThrashes,
+		Paused:    runnerPaused,
+	}
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomically(path, data)
+	}
+	if err != nil {
+		logrus.Warningln("Failed to save state:", err)
+	}
+}
+
+// loadState restores the state saved before the restart,
+// the images and the caches that are gone are dropped on the next check
+func loadState(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state PersistedState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	if state.Images != nil {
+		imagesUsed = state.Images
+	}
+	if state.Caches != nil {
+		cachesUsed = state.Caches
+	}
+	if state.Histories != nil {
+		imageHistories = state.Histories
+	}
+	imageRemovals = state.Removals
+	imageThrashes = state.Thrashes
+	runnerPaused = state.Paused
+
+	logrus.WithField("saved", state.Time).Infoln("Loaded the state of", len(imagesUsed), "images and",
+		len(cachesUsed), "caches")
+	return nil
+}
+
+// dumpState logs the state and the scores of all images and caches
+func dumpState() {
+	status := buildStatus()
+	for _, image := range status.Images {
+		logrus.WithFields(logrus.Fields{
+			"image":     image.ID,
+			"tags":      image.Tags,
+			"bytes":     image.Size,
+			"score":     image.Score,
+			"used":      image.Used,
+			"ttl":       image.TTL,
+			"protected": image.Protected,
+			"mirrored":  image.Mirrored,
+		}).Infoln("Image state")
+	}
+	for _, cache := range status.Caches {
+		logrus.WithFields(logrus.Fields{
+			"cache":   cache.ID,
+			"names":   cache.Names,
+			"project": cache.ProjectID,
+			"bytes":   cache.Size,
+			"score":   cache.Score,
+			"used":    cache.Used,
+			"ttl":     cache.TTL,
+		}).Infoln("Cache state")
+	}
+
+	fields := logrus.Fields{
+		"runner_paused":  status.RunnerPaused,
+		"image_removals": status.Removals,
+		"image_thrashes": status.Thrashes,
+	}
+	if status.DiskSpace != nil {
+		fields["bytes_free"] = humanize.Bytes(status.DiskSpace.BytesFree)
+		fields["files_free"] = status.DiskSpace.FilesFree
+	}
+	logrus.WithFields(fields).Infoln("State of", len(status.Images), "images and", len(status.Caches), "caches")
+}
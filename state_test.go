@@ -0,0 +1,48 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func (s *CleanupSuite) TestSaveAndLoadState(c *C) {
+	dir, err := ioutil.TempDir("", "state")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	s.dockerClient.images = []APIImages{
+		makeDockerImage("image1"),
+	}
+	err = updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	imageRemovals = 3
+	used := imagesUsed["image1"].Used
+	saveState(path)
+
+	imagesUsed = make(map[string]ImageInfo)
+	imageHistories = make(map[string]*ImageUsageHistory)
+	imageRemovals = 0
+	err = loadState(path)
+	c.Assert(err, IsNil)
+	c.Assert(imagesUsed, HasLen, 1)
+	c.Assert(imagesUsed["image1"].Used.Equal(used), Equals, true)
+	c.Assert(imageHistories["image1"], NotNil)
+	c.Assert(imageRemovals, Equals, int64(3))
+
+	err = updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	c.Assert(imagesUsed["image1"].Used.Equal(used), Equals, true)
+}
+
+func (s *CleanupSuite) TestLoadMissingState(c *C) {
+	err := loadState(filepath.Join(os.TempDir(), "missing-state.json"))
+	c.Assert(err, IsNil)
+	c.Assert(imagesUsed, HasLen, 0)
+
+	err = loadState("")
+	c.Assert(err, IsNil)
+}
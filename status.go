@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type ImageStatus struct {
+	ID        string                        `json:"id"`
+	Tags      []string                      `json:"tags,omitempty"`
+	Size      int64                         `json:"size"`
+	Score     int64                         `json:"score"`
+	Used      time.Time                     `json:"used"`
+	TTL       time.Time                     `json:"ttl"`
+	Protected bool                          `json:"protected"`
+	Mirrored  bool                          `json:"mirrored"`
+	LastJob   RunnerLabels                  `json:"last_job"`
+	History   map[string]*ImageUsageHistory `json:"history,omitempty"`
+}
+
+type CacheStatus struct {
+	ID        string    `json:"id"`
+	Names     []string  `json:"names,omitempty"`
+	ProjectID int64     `json:"project_id"`
+	Volume    bool      `json:"volume"`
+	Size      int64     `json:"size"`
+	Score     int64     `json:"score"`
+	Used      time.Time `json:"used"`
+	TTL       time.Time `json:"ttl"`
+}
+
+type Status struct {
+	Time         time.Time     `json:"time"`
+	DiskSpace    *DiskSpace    `json:"disk_space,omitempty"`
+	RunnerPaused bool          `json:"runner_paused"`
+	Removals     int64         `json:"image_removals"`
+	Thrashes     int64         `json:"image_thrashes"`
+	ThrashRate   float64       `json:"thrash_rate"`
+	Images       []ImageStatus `json:"images"`
+	Caches       []CacheStatus `json:"caches"`
+}
+
+var lastDiskSpace *DiskSpace
+
+func buildStatus() Status {
+	status := Status{
+		Time:         time.Now(),
+		DiskSpace:    lastDiskSpace,
+		RunnerPaused: runnerPaused,
+		Removals:     imageRemovals,
+		Thrashes:     imageThrashes,
+		ThrashRate:   thrashRate(),
+	}
+
+	for _, image := range imagesUsed {
+		imageStatus := ImageStatus{
+			ID:        image.ID,
+			Tags:      image.RepoTags,
+			Size:      image.Size,
+			Score:     image.score(),
+			Used:      image.Used,
+			TTL:       image.TTL,
+			Protected: isInternalImage(image.APIImages),
+			Mirrored:  image.Mirrored,
+			LastJob:   image.LastJob,
+		}
+		for _, key := range imageHistoryKeys(image.APIImages) {
+			if history, ok := imageHistories[key]; ok {
+				if imageStatus.History == nil {
+					imageStatus.History = make(map[string]*ImageUsageHistory)
+				}
+				imageStatus.History[key] = history
+			}
+		}
+		status.Images = append(status.Images, imageStatus)
+	}
+	sort.Slice(status.Images, func(i, j int) bool {
+		return status.Images[i].Score > status.Images[j].Score
+	})
+
+	for _, cache := range cachesUsed {
+		status.Caches = append(status.Caches, CacheStatus{
+			ID:        cache.ID,
+			Names:     cache.Names,
+			ProjectID: cache.Name.ProjectID,
+			Volume:    cache.Volume,
+			Size:      cache.size(),
+			Score:     cache.score(),
+			Used:      cache.Used,
+			TTL:       cache.TTL,
+		})
+	}
+	sort.Slice(status.Caches, func(i, j int) bool {
+		return status.Caches[i].Score > status.Caches[j].Score
+	})
+	return status
+}
+
+func writeStatus(path string) {
+	if path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(buildStatus(), "", "  ")
+	if err == nil {
+		err = writeFileAtomically(path, data)
+	}
+	if err != nil {
+		logrus.Warningln("Failed to write status:", err)
+	}
+}
+
+func readStatus(path string) (status Status, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &status)
+	return
+}
+
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func printStatus(status Status) {
+	fmt.Println("Status from", status.Time.Format(time.RFC3339))
+	if status.DiskSpace != nil {
+		fmt.Println("Free space:", humanize.Bytes(status.DiskSpace.BytesFree), "of", humanize.Bytes(status.DiskSpace.BytesTotal),
+			"free files:", status.DiskSpace.FilesFree, "of", status.DiskSpace.FilesTotal)
+	}
+	if status.RunnerPaused {
+		fmt.Println("The runner is paused")
+	}
+	if status.Removals > 0 {
+		fmt.Printf("Thrash rate: %.0f%%, %d of %d removed images were pulled again shortly after\n",
+			status.ThrashRate*100, status.Thrashes, status.Removals)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tTAGS\tSIZE\tSCORE\tUSED\tUSES\tREPULLS\tTHRASHES\tPROJECTS")
+	for _, image := range status.Images {
+		var uses, repulls, thrashes int64
+		var projects []string
+		for _, history := range image.History {
+			uses += history.UseCount
+			repulls += history.Repulls
+			thrashes += history.Thrashes
+			for _, project := range history.Projects {
+				projects = append(projects, fmt.Sprint(project))
+			}
+		}
+		score := fmt.Sprint(image.Score)
+		if image.Protected {
+			score = "protected"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", shortID(image.ID), strings.Join(image.Tags, ","),
+			humanize.Bytes(uint64(image.Size)), score, humanize.Time(image.Used), uses, repulls, thrashes, strings.Join(projects, ","))
+	}
+	w.Flush()
+	fmt.Println()
+
+	fmt.Fprintln(w, "CACHE\tPROJECT\tSIZE\tSCORE\tUSED")
+	for _, cache := range status.Caches {
+		name := cache.ID
+		if len(cache.Names) > 0 {
+			name = strings.TrimPrefix(cache.Names[0], "/")
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", name, cache.ProjectID,
+			humanize.Bytes(uint64(cache.Size)), cache.Score, humanize.Time(cache.Used))
+	}
+	w.Flush()
+}
+
+func runStatus(c *cli.Context) error {
+	if opts.StatusFile == "" {
+		return errors.New("the status file is not configured")
+	}
+
+	status, err := readStatus(opts.StatusFile)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	printStatus(status)
+	return nil
+}
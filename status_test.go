@@ -0,0 +1,36 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"path/filepath"
+)
+
+func (s *CleanupSuite) TestStatusFile(c *C) {
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("test", 100),
+		makeDockerImage("gitlab/gitlab-runner:latest"),
+	}
+	s.dockerClient.containers = []APIContainers{makeDockerCache("cache", 10)}
+	s.dockerClient.freeSpace = 1000
+	s.dockerClient.freeFiles = 1000
+
+	err := doCycle(s.dockerClient, 0, 0, 0, 0)
+	c.Assert(err, IsNil)
+
+	path := filepath.Join(c.MkDir(), "status.json")
+	writeStatus(path)
+
+	status, err := readStatus(path)
+	c.Assert(err, IsNil)
+	c.Assert(status.DiskSpace, NotNil)
+	c.Assert(status.DiskSpace.BytesFree, Equals, uint64(1000))
+	c.Assert(status.Images, HasLen, 2)
+	c.Assert(status.Caches, HasLen, 1)
+	c.Assert(status.Caches[0].ProjectID, Equals, int64(1))
+
+	for _, image := range status.Images {
+		c.Assert(image.History, HasLen, 1)
+		c.Assert(image.Protected, Equals, image.ID == "gitlab/gitlab-runner:latest")
+	}
+}
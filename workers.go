@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+// forEachParallel calls fn for every index from 0 to count,
+// at most workers calls run at the same time
+func forEachParallel(count, workers int, fn func(idx int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > count {
+		workers = count
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				fn(idx)
+			}
+		}()
+	}
+	for idx := 0; idx < count; idx++ {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// inspectContainers inspects the containers in parallel and handles the results one by one,
+// the containers they link to are inspected in the next round. The containers inspected
+// in the previous checks are taken from the cache and every container is handled once.
+func inspectContainers(client DockerClient, ids []string) {
+	handled := make(map[string]bool)
+	for len(ids) > 0 {
+		var round, pending []string
+		containers := make(map[string]*docker.Container)
+		for _, id := range ids {
+			id = resolveContainerID(id)
+			if handled[id] {
+				continue
+			}
+			handled[id] = true
+			round = append(round, id)
+			if container, ok := inspectedContainers[id]; ok {
+				containers[id] = container
+			} else {
+				pending = append(pending, id)
+			}
+		}
+
+		inspected := make([]*docker.Container, len(pending))
+		forEachParallel(len(pending), opts.InspectWorkers, func(idx int) {
+			container, err := client.InspectContainer(dockerContext, pending[idx])
+			if err != nil {
+				logrus.Warningln("Failed to inspect container", pending[idx], err)
+				return
+			}
+			inspected[idx] = container
+		})
+		for idx, container := range inspected {
+			if container != nil {
+				containers[pending[idx]] = container
+				inspectedContainers[container.ID] = container
+			}
+		}
+
+		var linked []string
+		for _, id := range round {
+			if container, ok := containers[id]; ok {
+				linked = append(linked, handleDockerContainer(client, container)...)
+			}
+		}
+		ids = linked
+	}
+}
+
+// Removal is an image or a cache selected to be removed in a batch
+type Removal struct {
+	image    *docker.APIImages
+	cache    *CacheInfo
+	expected int64
+	untagged bool
+	err      error
+}
+
+func removalWorkers() int {
+	if opts.RemovalWorkers < 1 {
+		return 1
+	}
+	return opts.RemovalWorkers
+}
+
+// removeBatch removes the images and the caches in parallel,
+// the state maps are only read while the removals run
+func removeBatch(client DockerClient, batch []Removal) {
+	forEachParallel(len(batch), opts.RemovalWorkers, func(idx int) {
+		removal := &batch[idx]
+		if removal.image != nil {
+			removal.untagged, removal.err = removeImage(client, *removal.image)
+		} else {
+			removal.err = removeCache(client, *removal.cache)
+		}
+		cycleBudget.wait()
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	. "github.com/fsouza/go-dockerclient"
+	. "gopkg.in/check.v1"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func (s *CleanupSuite) TestForEachParallelBoundsWorkers(c *C) {
+	var running, maxRunning int32
+	var lock sync.Mutex
+	called := make(map[int]int)
+
+	forEachParallel(20, 3, func(idx int) {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		lock.Lock()
+		called[idx]++
+		if current > maxRunning {
+			maxRunning = current
+		}
+		lock.Unlock()
+		time.Sleep(time.Millisecond)
+	})
+
+	c.Assert(called, HasLen, 20)
+	for idx := 0; idx < 20; idx++ {
+		c.Assert(called[idx], Equals, 1)
+	}
+	c.Assert(maxRunning <= 3, Equals, true)
+}
+
+func (s *CleanupSuite) TestParallelInspection(c *C) {
+	opts.InspectWorkers = 4
+	s.dockerClient.images = []APIImages{
+		makeDockerImage("image1"),
+		makeDockerImage("image2"),
+		makeDockerImage("image3"),
+	}
+	s.dockerClient.containers = []APIContainers{
+		makeDockerContainer("container1", "image1"),
+		makeDockerContainer("container2", "image2"),
+		makeDockerContainer("container3", "image3"),
+	}
+	s.dockerClient.links = []string{"container3:alias"}
+
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+	err = updateContainers(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	c.Assert(imagesUsed["image1"].Used.IsZero(), Equals, false)
+	c.Assert(imagesUsed["image2"].Used.IsZero(), Equals, false)
+	c.Assert(imagesUsed["image3"].Used.IsZero(), Equals, false)
+	c.Assert(imageHistories["image1"].UseCount, Equals, int64(1))
+}
+
+func (s *CleanupSuite) TestBatchRemoval(c *C) {
+	opts.RemovalWorkers = 5
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("image1", 100),
+		makeDockerImageWithSize("image2", 100),
+		makeDockerImageWithSize("image3", 100),
+		makeDockerImageWithSize("image4", 100),
+		makeDockerImageWithSize("image5", 100),
+	}
+	s.dockerClient.freeFiles = 1000
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	err = doFreeSpace(s.dockerClient, 250, 0)
+	c.Assert(err, IsNil)
+	c.Assert(s.dockerClient.removedImages, HasLen, 3)
+	c.Assert(s.dockerClient.freeSpace, Equals, uint64(300))
+}
+
+func (s *CleanupSuite) TestBatchRemovalFailure(c *C) {
+	opts.RemovalWorkers = 2
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("image1", 100),
+		makeDockerImageWithSize("image2", 100),
+	}
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	s.dockerClient.error = errNothingToDelete
+	err = doFreeSpace(s.dockerClient, 1000, 0)
+	c.Assert(err, NotNil)
+	c.Assert(s.dockerClient.removedImages, HasLen, 0)
+}
+
+func (s *CleanupSuite) TestBatchExcludesParentsOfBatchedImages(c *C) {
+	opts.RemovalWorkers = 3
+	s.dockerClient.images = []APIImages{
+		makeDockerImageWithSize("parent", 100),
+		makeDockerImageWithSize("other", 100),
+		{ID: "child", RepoTags: []string{"child"}, ParentID: "parent", Size: 150},
+	}
+	s.dockerClient.freeFiles = 1000
+	err := updateImages(s.dockerClient)
+	c.Assert(err, IsNil)
+
+	err = doFreeSpace(s.dockerClient, 1000, 0)
+	c.Assert(err, Equals, errNothingToDelete)
+	c.Assert(s.dockerClient.removedImages, HasLen, 3)
+	c.Assert(s.dockerClient.removedImages[2], Equals, "parent")
+}